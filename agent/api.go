@@ -0,0 +1,365 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// openAPISpec documents the REST API below; served at /api/v1/openapi.json.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// registerAPI mounts the versioned REST API. Every endpoint except the
+// OpenAPI document requires a bearer token with at least the given role.
+func (s *Server) registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPISpec)
+	})
+	mux.HandleFunc("GET /api/v1/sessions", s.requireAuth(RoleViewer, s.handleListSessions))
+	mux.HandleFunc("POST /api/v1/sessions", s.requireAuth(RoleOperator, s.handleCreateSession))
+	mux.HandleFunc("DELETE /api/v1/sessions/{id}", s.requireAuth(RoleOperator, s.handleKillSession))
+	mux.HandleFunc("GET /api/v1/sessions/{id}/screen", s.requireAuth(RoleViewer, s.handleSessionScreen))
+	mux.HandleFunc("POST /api/v1/sessions/{id}/prompt", s.requireAuth(RoleOperator, s.handleSendPrompt))
+	mux.HandleFunc("GET /api/v1/machine", s.requireAuth(RoleViewer, s.handleMachine))
+	mux.HandleFunc("GET /api/v1/machine/history", s.requireAuth(RoleViewer, s.handleMetricsHistory))
+	mux.HandleFunc("GET /api/v1/usage", s.requireAuth(RoleViewer, s.handleUsage))
+	mux.HandleFunc("GET /api/v1/recordings", s.requireAuth(RoleViewer, s.handleListRecordings))
+	mux.HandleFunc("GET /api/v1/recordings/{recording}", s.requireAuth(RoleViewer, s.handleGetRecording))
+	mux.HandleFunc("GET /api/v1/audit", s.requireAuth(RoleAdmin, s.handleAudit))
+	mux.HandleFunc("GET /api/v1/events", s.requireAuth(RoleViewer, s.handleEvents))
+	mux.HandleFunc("GET /api/v1/conversations", s.requireAuth(RoleViewer, s.handleListConversations))
+
+	metrics := s.requireAuth(RoleViewer, s.handlePrometheus)
+	if s.config.MetricsPublic {
+		metrics = s.handlePrometheus
+	}
+	mux.HandleFunc("GET /metrics", metrics)
+}
+
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// requireAuth wraps an HTTP handler with the bearer token check. The token
+// must carry at least role and, for /sessions/{id} routes, have the session
+// in scope. Handlers get the principal from principalFrom.
+func (s *Server) requireAuth(role Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := s.auth.authenticate(requestToken(r))
+		if !ok {
+			s.audit.Record(AuditEvent{Remote: r.RemoteAddr, Action: "auth", Outcome: "denied"})
+			writeAPIError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if !p.allows(role) {
+			s.auditDenied(r, p)
+			writeAPIError(w, http.StatusForbidden, "requires "+string(role)+" role")
+			return
+		}
+		if id := r.PathValue("id"); id != "" && !s.canAccessSession(p, id) {
+			s.auditDenied(r, p)
+			writeAPIError(w, http.StatusForbidden, "session outside token scope")
+			return
+		}
+		next(w, r.WithContext(withPrincipal(r.Context(), p)))
+	}
+}
+
+// apiActions maps mutating REST routes to the audit action they perform.
+var apiActions = map[string]string{
+	"POST /api/v1/sessions":             "create_session",
+	"DELETE /api/v1/sessions/{id}":      "kill_session",
+	"POST /api/v1/sessions/{id}/prompt": "send_prompt",
+}
+
+// auditRequest records the outcome of a mutating REST call.
+func (s *Server) auditRequest(r *http.Request, sessionID, detail string, err error) {
+	s.audit.Record(AuditEvent{
+		Remote:    r.RemoteAddr,
+		Token:     principalFrom(r).Name,
+		Action:    apiActions[r.Pattern],
+		SessionID: sessionID,
+		Detail:    detail,
+		Outcome:   outcome(err),
+	})
+}
+
+// auditDenied records a mutating REST call refused by role or scope.
+func (s *Server) auditDenied(r *http.Request, p *principal) {
+	if action, ok := apiActions[r.Pattern]; ok {
+		s.audit.Record(AuditEvent{
+			Remote: r.RemoteAddr, Token: p.Name, Action: action,
+			SessionID: r.PathValue("id"), Outcome: outcome(errDenied),
+		})
+	}
+}
+
+type sendPromptRequest struct {
+	Text        string `json:"text"`
+	Submit      bool   `json:"submit"`
+	RequireIdle bool   `json:"require_idle"`
+}
+
+// handleSendPrompt serves POST /api/v1/sessions/{id}/prompt.
+func (s *Server) handleSendPrompt(w http.ResponseWriter, r *http.Request) {
+	var req sendPromptRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.Text == "" && !req.Submit {
+		writeAPIError(w, http.StatusBadRequest, "text required")
+		return
+	}
+
+	id := r.PathValue("id")
+	err := s.sendPrompt(id, req.Text, req.Submit, req.RequireIdle)
+	s.auditRequest(r, id, "", err)
+	switch {
+	case errors.Is(err, errSessionNotFound):
+		writeAPIError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errSessionNotIdle):
+		writeAPIError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{"session_id": id, "status": "sent"})
+	}
+}
+
+// handleListSessions serves GET /api/v1/sessions.
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := principalFrom(r).filterSessions(s.poller.GetSessions())
+	writeJSON(w, http.StatusOK, map[string]any{"sessions": sessions})
+}
+
+// handleCreateSession serves POST /api/v1/sessions.
+func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
+	var req createSessionRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	sessionID, name, err := s.createSession(req, principalFrom(r))
+	s.auditRequest(r, sessionID, req.Workdir, err)
+	switch {
+	case errors.Is(err, errWorkdirNotAllowed):
+		writeAPIError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, errUnknownProfile), errors.Is(err, errResumeNeedsClaude), errors.Is(err, errConversationWorkdir):
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, errConversationNotFound):
+		writeAPIError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+	default:
+		writeJSON(w, http.StatusCreated, map[string]string{"session_id": sessionID, "name": name})
+	}
+}
+
+// handleKillSession serves DELETE /api/v1/sessions/{id}.
+func (s *Server) handleKillSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, ok := s.poller.GetSession(id); !ok {
+		s.auditRequest(r, id, "", errSessionNotFound)
+		writeAPIError(w, http.StatusNotFound, errSessionNotFound.Error())
+		return
+	}
+	err := s.killSession(id)
+	s.auditRequest(r, id, "", err)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSessionScreen serves GET /api/v1/sessions/{id}/screen. The optional
+// history query parameter prepends that many lines of scrollback.
+func (s *Server) handleSessionScreen(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	info, ok := s.poller.GetSession(id)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, errSessionNotFound.Error())
+		return
+	}
+
+	screen, err := capturePaneVisible(id)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "failed to capture pane")
+		return
+	}
+	if h := r.URL.Query().Get("history"); h != "" {
+		lines, err := strconv.Atoi(h)
+		if err != nil || lines < 0 {
+			writeAPIError(w, http.StatusBadRequest, "history must be a non-negative integer")
+			return
+		}
+		if lines > 0 {
+			history, err := capturePaneHistory(id, min(lines, s.config.HistoryLimit), false)
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, "failed to capture pane")
+				return
+			}
+			screen = history + screen
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"session_id": id,
+		"state":      info.State,
+		"screen":     screen,
+	})
+}
+
+// handleMachine serves GET /api/v1/machine.
+func (s *Server) handleMachine(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.machineInfo())
+}
+
+// handleMetricsHistory serves GET /api/v1/machine/history, selected by the
+// same fields as the metrics_history message.
+func (s *Server) handleMetricsHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	msg := ClientMessage{
+		Since: q.Get("since"),
+		Until: q.Get("until"),
+		Range: q.Get("range"),
+		Step:  q.Get("step"),
+	}
+	query, err := msg.historyQuery()
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	points, step := s.history.Query(query)
+	writeJSON(w, http.StatusOK, map[string]any{"step_secs": int64(step / time.Second), "points": points})
+}
+
+// handleUsage serves GET /api/v1/usage, optionally filtered by an RFC 3339
+// since timestamp.
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "since must be an RFC 3339 timestamp")
+			return
+		}
+		since = t
+	}
+	entries := principalFrom(r).filterUsage(s.usage.Collect(since))
+	s.costs.price(entries)
+	writeJSON(w, http.StatusOK, map[string]any{"entries": entries, "cursor": usageCursor(entries)})
+}
+
+// handleListRecordings serves GET /api/v1/recordings, optionally filtered by
+// session_id.
+func (s *Server) handleListRecordings(w http.ResponseWriter, r *http.Request) {
+	recs := s.recordingsFor(principalFrom(r), r.URL.Query().Get("session_id"))
+	writeJSON(w, http.StatusOK, map[string]any{"recordings": recs})
+}
+
+// handleGetRecording serves GET /api/v1/recordings/{recording} as an
+// asciicast v2 file, playable with asciinema.
+func (s *Server) handleGetRecording(w http.ResponseWriter, r *http.Request) {
+	f, err := s.openRecording(principalFrom(r), r.PathValue("recording"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	io.Copy(w, f)
+}
+
+// handleAudit serves GET /api/v1/audit, filtered by the same fields as the
+// get_audit message.
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	msg := ClientMessage{
+		SessionID: q.Get("session_id"),
+		Token:     q.Get("token_name"),
+		Action:    q.Get("action"),
+		Since:     q.Get("since"),
+		Until:     q.Get("until"),
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			writeAPIError(w, http.StatusBadRequest, "limit must be a non-negative integer")
+			return
+		}
+		msg.Limit = limit
+	}
+	filter, err := msg.auditFilter()
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"events": s.audit.Query(filter)})
+}
+
+// handleEvents serves GET /api/v1/events, filtered by the same fields as the
+// get_events message.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if s.events == nil {
+		writeAPIError(w, http.StatusNotFound, errEventsDisabled.Error())
+		return
+	}
+	q := r.URL.Query()
+	msg := ClientMessage{
+		Conversation: q.Get("conversation_id"),
+		Workdir:      q.Get("workdir"),
+		Since:        q.Get("since"),
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			writeAPIError(w, http.StatusBadRequest, "limit must be a non-negative integer")
+			return
+		}
+		msg.Limit = limit
+	}
+	filter, err := msg.eventFilter()
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"events": s.events.Query(principalFrom(r), filter)})
+}
+
+// handleListConversations serves GET /api/v1/conversations, optionally for
+// one workdir.
+func (s *Server) handleListConversations(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			writeAPIError(w, http.StatusBadRequest, "limit must be a non-negative integer")
+			return
+		}
+	}
+	convs, err := s.listConversations(principalFrom(r), q.Get("workdir"), limit)
+	switch {
+	case errors.Is(err, errWorkdirNotAllowed):
+		writeAPIError(w, http.StatusForbidden, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, map[string]any{"conversations": convs})
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AuditEvent is one control action taken on the agent.
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	Token     string    `json:"token"`  // principal name
+	Action    string    `json:"action"` // message type, e.g. kill_session
+	SessionID string    `json:"session_id,omitempty"`
+	Detail    string    `json:"detail,omitempty"` // e.g. workdir for create_session
+	Outcome   string    `json:"outcome"`          // "ok", "denied" or the error
+}
+
+// AuditFilter selects events for get_audit. Zero fields match everything.
+type AuditFilter struct {
+	Since     time.Time
+	Until     time.Time
+	SessionID string
+	Token     string
+	Action    string
+	Limit     int // most recent matches returned; default and cap below
+}
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 5000
+)
+
+func (f AuditFilter) match(e AuditEvent) bool {
+	return (f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until)) &&
+		(f.SessionID == "" || e.SessionID == f.SessionID) &&
+		(f.Token == "" || e.Token == f.Token) &&
+		(f.Action == "" || e.Action == f.Action)
+}
+
+// auditedActions are the message types recorded in the audit log, including
+// attempts denied by role or scope.
+var auditedActions = map[string]bool{
+	"create_session": true,
+	"kill_session":   true,
+	"rename_session": true,
+	"set_tags":       true,
+	"set_note":       true,
+	"send_prompt":    true,
+	"respond_prompt": true,
+	"attach":         true,
+	"detach":         true,
+	"take_control":   true,
+	"self_update":    true,
+}
+
+var errDenied = errors.New("denied")
+
+// auditFilter parses the get_audit fields of msg.
+func (msg ClientMessage) auditFilter() (AuditFilter, error) {
+	f := AuditFilter{SessionID: msg.SessionID, Token: msg.Token, Action: msg.Action, Limit: msg.Limit}
+	var err error
+	if msg.Since != "" {
+		if f.Since, err = time.Parse(time.RFC3339, msg.Since); err != nil {
+			return f, errors.New("since must be an RFC 3339 timestamp")
+		}
+	}
+	if msg.Until != "" {
+		if f.Until, err = time.Parse(time.RFC3339, msg.Until); err != nil {
+			return f, errors.New("until must be an RFC 3339 timestamp")
+		}
+	}
+	return f, nil
+}
+
+func defaultAuditLogPath() string {
+	return filepath.Join(agentDataDir(), "audit.log")
+}
+
+// auditLog is an append-only JSON lines file. When it would grow past
+// maxSize it is renamed to path.1 (shifting older files up to path.<keep>)
+// and a fresh file is started.
+type auditLog struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openAuditLog(path string, maxSize int64, keep int) (*auditLog, error) {
+	a := &auditLog{path: path, maxSize: maxSize, keep: keep}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("creating audit log dir: %w", err)
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	a.file, a.size = f, info.Size()
+	return nil
+}
+
+// Record appends e, stamping the time if unset. Failures are logged, never
+// returned: auditing must not block the action itself.
+func (a *auditLog) Record(e AuditEvent) {
+	if a == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return
+	}
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			log.Printf("audit: rotate: %v", err)
+			if a.file == nil {
+				return
+			}
+		}
+	}
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+// rotate shifts path.N-1 → path.N … path → path.1 and reopens path.
+// Callers must hold a.mu.
+func (a *auditLog) rotate() error {
+	a.file.Close()
+	a.file = nil
+	for i := a.keep - 1; i >= 1; i-- {
+		os.Rename(a.rotatedPath(i), a.rotatedPath(i+1))
+	}
+	if a.keep > 0 {
+		if err := os.Rename(a.path, a.rotatedPath(1)); err != nil {
+			a.open()
+			return err
+		}
+	} else {
+		os.Remove(a.path)
+	}
+	return a.open()
+}
+
+func (a *auditLog) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", a.path, i)
+}
+
+// Query returns the most recent events matching f, oldest first, reading the
+// rotated files as well as the current one.
+func (a *auditLog) Query(f AuditFilter) []AuditEvent {
+	if f.Limit <= 0 {
+		f.Limit = defaultAuditLimit
+	}
+	f.Limit = min(f.Limit, maxAuditLimit)
+	result := []AuditEvent{}
+	if a == nil {
+		return result
+	}
+
+	// Open the files under the lock so a rotation can't move them between
+	// listing and opening, then read without it: Record must not wait on
+	// a query, and an open file reads the same whatever it's renamed to.
+	a.mu.Lock()
+	var files []*os.File
+	for i := a.keep; i >= 0; i-- {
+		path := a.path
+		if i > 0 {
+			path = a.rotatedPath(i)
+		}
+		if file, err := os.Open(path); err == nil {
+			files = append(files, file)
+		}
+	}
+	a.mu.Unlock()
+
+	for _, file := range files {
+		// ReadBytes rather than a Scanner, which stops at a line over 64 KiB.
+		r := bufio.NewReader(file)
+		for {
+			line, err := r.ReadBytes('\n')
+			var e AuditEvent
+			if len(line) > 0 && json.Unmarshal(line, &e) == nil && f.match(e) {
+				result = append(result, e)
+				if len(result) > f.Limit {
+					result = result[1:]
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		file.Close()
+	}
+	return result
+}
+
+func (a *auditLog) Close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+// outcome renders an action's error for the audit log.
+func outcome(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
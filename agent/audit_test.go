@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sessionIDs(events []AuditEvent) string {
+	ids := make([]string, len(events))
+	for i, e := range events {
+		ids[i] = e.SessionID
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// Room for one event per file, so every Record after the first rotates.
+	a, err := openAuditLog(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for i := range 5 {
+		a.Record(AuditEvent{Action: "kill_session", SessionID: fmt.Sprint(i), Outcome: "ok"})
+	}
+
+	for _, name := range []string{"audit.log", "audit.log.1", "audit.log.2"} {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(path), name)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("audit.log.3 kept past keep=2")
+	}
+	if got := sessionIDs(a.Query(AuditFilter{})); got != "2,3,4" {
+		t.Errorf("Query over rotated files = %s, want 2,3,4", got)
+	}
+}
+
+func TestAuditLogRotateKeepZero(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := openAuditLog(path, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for i := range 3 {
+		a.Record(AuditEvent{Action: "kill_session", SessionID: fmt.Sprint(i), Outcome: "ok"})
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("audit.log.1 kept with keep=0")
+	}
+	if got := sessionIDs(a.Query(AuditFilter{})); got != "2" {
+		t.Errorf("Query = %s, want 2", got)
+	}
+}
+
+func TestAuditLogQuery(t *testing.T) {
+	a, err := openAuditLog(filepath.Join(t.TempDir(), "audit.log"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range 10 {
+		action := "kill_session"
+		if i%2 == 1 {
+			action = "send_prompt"
+		}
+		a.Record(AuditEvent{Time: start.Add(time.Duration(i) * time.Minute), Action: action, SessionID: fmt.Sprint(i), Outcome: "ok"})
+	}
+	a.Record(AuditEvent{Time: start.Add(time.Hour), Action: "set_note", SessionID: "long", Detail: strings.Repeat("x", 100*1024)})
+
+	tests := []struct {
+		name   string
+		filter AuditFilter
+		want   string
+	}{
+		{"default limit", AuditFilter{}, "0,1,2,3,4,5,6,7,8,9,long"},
+		{"limit keeps the newest", AuditFilter{Limit: 3}, "8,9,long"},
+		{"action", AuditFilter{Action: "send_prompt", Limit: 2}, "7,9"},
+		{"session", AuditFilter{SessionID: "4"}, "4"},
+		{"since and until", AuditFilter{Since: start.Add(2 * time.Minute), Until: start.Add(5 * time.Minute)}, "2,3,4"},
+		{"line over 64 KiB", AuditFilter{Action: "set_note"}, "long"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sessionIDs(a.Query(tt.filter)); got != tt.want {
+				t.Errorf("Query = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuditLogQueryLimitCap(t *testing.T) {
+	a, err := openAuditLog(filepath.Join(t.TempDir(), "audit.log"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for range maxAuditLimit + 10 {
+		a.Record(AuditEvent{Action: "detach", Outcome: "ok"})
+	}
+	if got := len(a.Query(AuditFilter{Limit: maxAuditLimit * 2})); got != maxAuditLimit {
+		t.Errorf("Query returned %d events, want the cap %d", got, maxAuditLimit)
+	}
+	if got := len(a.Query(AuditFilter{})); got != defaultAuditLimit {
+		t.Errorf("Query returned %d events, want the default %d", got, defaultAuditLimit)
+	}
+}
@@ -1,27 +1,548 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
-func checkAuth(r *http.Request, token string) bool {
-	if token == "" {
-		return true // No auth configured
+// Role is what a token may do. Each role includes the ones below it.
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"   // watch sessions, attach read-only
+	RoleOperator Role = "operator" // create, drive and manage sessions
+	RoleAdmin    Role = "admin"    // everything, including self_update
+)
+
+var roleRank = map[Role]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// messageRoles is the minimum role for each WebSocket message type. Types
+// not listed here are admin-only.
+var messageRoles = map[string]Role{
+	"list_sessions":      RoleViewer,
+	"attach":             RoleViewer, // forced read-only below operator
+	"detach":             RoleViewer,
+	"machine_info":       RoleViewer,
+	"metrics":            RoleViewer,
+	"metrics_history":    RoleViewer,
+	"test_rules":         RoleViewer,
+	"list_recordings":    RoleViewer,
+	"get_recording":      RoleViewer,
+	"auth":               RoleViewer,
+	"usage_since":        RoleViewer,
+	"get_events":         RoleViewer,
+	"list_conversations": RoleViewer,
+	"get_audit":          RoleAdmin,
+	"create_session":     RoleOperator,
+	"kill_session":       RoleOperator,
+	"rename_session":     RoleOperator,
+	"set_tags":           RoleOperator,
+	"set_note":           RoleOperator,
+	"send_prompt":        RoleOperator,
+	"respond_prompt":     RoleOperator,
+	"take_control":       RoleOperator,
+	"input":              RoleOperator,
+	"resize":             RoleOperator,
+	"self_update":        RoleAdmin,
+}
+
+func requiredRole(msgType string) Role {
+	if role, ok := messageRoles[msgType]; ok {
+		return role
 	}
+	return RoleAdmin
+}
+
+// TokenConfig is one entry of the tokens list, inline in agent.yaml or in
+// the tokens file managed by `ccdash-agent token`. Only the SHA-256 hash of
+// the secret needs to be stored; inline entries may give the secret itself.
+type TokenConfig struct {
+	Name     string    `yaml:"name"`
+	Hash     string    `yaml:"hash,omitempty"`  // hex SHA-256 of the secret
+	Token    string    `yaml:"token,omitempty"` // plaintext secret, inline config only
+	Role     Role      `yaml:"role"`
+	Workdirs []string  `yaml:"workdirs,omitempty"` // scope; empty means every allowed workdir
+	Expires  time.Time `yaml:"expires,omitempty"`
+}
+
+// tokensFile is the on-disk format of tokens_file.
+type tokensFile struct {
+	Tokens []TokenConfig `yaml:"tokens"`
+}
+
+func defaultTokensFile() string {
+	return filepath.Join(agentDataDir(), "tokens.yaml")
+}
+
+// principal is an authenticated client: who it is and what it may touch.
+type principal struct {
+	Name     string
+	Role     Role
+	Workdirs []string // expanded; empty means unscoped
+	Expires  time.Time
+	hash     [sha256.Size]byte
+}
+
+// anonymous is the principal when no token is configured at all.
+var anonymous = &principal{Name: "anonymous", Role: RoleAdmin}
+
+func (p *principal) allows(role Role) bool {
+	return roleRank[p.Role] >= roleRank[role]
+}
+
+// inScope reports whether workdir lies within the principal's workdir scope.
+func (p *principal) inScope(workdir string) bool {
+	if len(p.Workdirs) == 0 {
+		return true
+	}
+	return workdirWithin(workdir, p.Workdirs)
+}
+
+// canSee reports whether the principal may see or act on a session.
+func (p *principal) canSee(info *SessionInfo) bool {
+	return p.inScope(info.Workdir)
+}
+
+// filterSessions returns the sessions within the principal's scope.
+func (p *principal) filterSessions(sessions []*SessionInfo) []*SessionInfo {
+	if len(p.Workdirs) == 0 {
+		return sessions
+	}
+	result := make([]*SessionInfo, 0, len(sessions))
+	for _, info := range sessions {
+		if p.canSee(info) {
+			result = append(result, info)
+		}
+	}
+	return result
+}
+
+// filterUsage returns the usage entries within the principal's scope.
+func (p *principal) filterUsage(entries []UsageEntry) []UsageEntry {
+	if len(p.Workdirs) == 0 {
+		return entries
+	}
+	result := make([]UsageEntry, 0, len(entries))
+	for _, e := range entries {
+		if p.inScope(e.Workdir) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
 
-	// Check Authorization header
-	auth := r.Header.Get("Authorization")
-	if strings.HasPrefix(auth, "Bearer ") {
-		if strings.TrimPrefix(auth, "Bearer ") == token {
+// workdirWithin reports whether dir is one of roots or below one of them.
+func workdirWithin(dir string, roots []string) bool {
+	clean := filepath.Clean(dir)
+	for _, root := range roots {
+		rootClean := filepath.Clean(root)
+		if clean == rootClean || strings.HasPrefix(clean, rootClean+string(filepath.Separator)) {
 			return true
 		}
 	}
+	return false
+}
+
+// authenticator resolves secrets to principals. The legacy single token is
+// an admin named "default". The tokens file is re-read by watchTokens when it
+// changes, so minted and revoked tokens take effect without a restart.
+type authenticator struct {
+	legacy     *principal
+	inline     []*principal
+	tokensPath string
+
+	mu      sync.RWMutex
+	fileMod time.Time
+	file    []*principal
+	known   map[tokenKey]bool // every current token, for valid
+}
+
+// tokenKey identifies a token: a revoked and re-minted name gets a new hash.
+type tokenKey struct {
+	name string
+	hash [sha256.Size]byte
+}
+
+func newAuthenticator(cfg *Config) (*authenticator, error) {
+	a := &authenticator{tokensPath: expandPath(cfg.TokensFile)}
+	if cfg.Token != "" {
+		a.legacy = &principal{Name: "default", Role: RoleAdmin, hash: sha256.Sum256([]byte(cfg.Token))}
+	}
+	inline, err := compileTokens(cfg.Tokens)
+	if err != nil {
+		return nil, err
+	}
+	a.inline = inline
+	if err := a.reloadTokens(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// watchTokens reloads the tokens file whenever it changes.
+func (a *authenticator) watchTokens(interval time.Duration) {
+	if a.tokensPath == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.reloadTokens()
+	}
+}
+
+// reloadTokens re-reads the tokens file if it changed since the last read.
+// A broken file keeps the previous entries.
+func (a *authenticator) reloadTokens() error {
+	mod := modTime(a.tokensPath)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.known != nil && mod.Equal(a.fileMod) {
+		return nil
+	}
+	a.fileMod = mod
+	if a.tokensPath != "" {
+		tf, err := readTokensFile(a.tokensPath)
+		if err == nil {
+			var file []*principal
+			if file, err = compileTokens(tf.Tokens); err == nil {
+				a.file = file
+			} else {
+				err = fmt.Errorf("%s: %w", a.tokensPath, err)
+			}
+		}
+		if err != nil {
+			log.Printf("tokens: %v (keeping previous tokens)", err)
+			return err
+		}
+	}
+	a.known = make(map[tokenKey]bool)
+	for _, p := range a.allLocked() {
+		a.known[tokenKey{p.Name, p.hash}] = true
+	}
+	return nil
+}
+
+// required reports whether clients must authenticate at all.
+func (a *authenticator) required() bool {
+	return a.count() > 0
+}
+
+// count returns how many tokens are currently configured.
+func (a *authenticator) count() int {
+	n := len(a.inline)
+	if a.legacy != nil {
+		n++
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return n + len(a.file)
+}
+
+// authenticate returns the principal for secret. Every candidate is compared
+// in constant time so the scan doesn't leak which prefix matched.
+func (a *authenticator) authenticate(secret string) (*principal, bool) {
+	if !a.required() {
+		return anonymous, true
+	}
+	sum := sha256.Sum256([]byte(secret))
+	var match *principal
+	a.mu.RLock()
+	all := a.allLocked()
+	a.mu.RUnlock()
+	for _, p := range all {
+		if subtle.ConstantTimeCompare(sum[:], p.hash[:]) == 1 && match == nil {
+			match = p
+		}
+	}
+	if match == nil || match.expired() {
+		return nil, false
+	}
+	return match, true
+}
+
+// valid reports whether p may still be used: not expired and, for file
+// tokens, not revoked since it authenticated.
+func (a *authenticator) valid(p *principal) bool {
+	if p == anonymous {
+		return !a.required()
+	}
+	if p.expired() {
+		return false
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.known[tokenKey{p.Name, p.hash}]
+}
+
+func (p *principal) expired() bool {
+	return !p.Expires.IsZero() && time.Now().After(p.Expires)
+}
+
+// allLocked returns every configured principal. Callers must hold a.mu.
+func (a *authenticator) allLocked() []*principal {
+	var all []*principal
+	if a.legacy != nil {
+		all = append(all, a.legacy)
+	}
+	all = append(all, a.inline...)
+	return append(all, a.file...)
+}
+
+func compileTokens(tokens []TokenConfig) ([]*principal, error) {
+	var result []*principal
+	for _, t := range tokens {
+		if t.Name == "" {
+			return nil, fmt.Errorf("token without a name")
+		}
+		if _, ok := roleRank[t.Role]; !ok {
+			return nil, fmt.Errorf("token %q: unknown role %q", t.Name, t.Role)
+		}
+		p := &principal{Name: t.Name, Role: t.Role, Expires: t.Expires}
+		switch {
+		case t.Token != "":
+			p.hash = sha256.Sum256([]byte(t.Token))
+		case t.Hash != "":
+			b, err := hex.DecodeString(t.Hash)
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("token %q: hash must be a hex SHA-256", t.Name)
+			}
+			copy(p.hash[:], b)
+		default:
+			return nil, fmt.Errorf("token %q: token or hash required", t.Name)
+		}
+		for _, d := range t.Workdirs {
+			p.Workdirs = append(p.Workdirs, expandPath(d))
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+// readTokensFile reads a tokens file. A missing file has no tokens.
+func readTokensFile(path string) (tokensFile, error) {
+	var tf tokensFile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return tf, nil
+		}
+		return tf, fmt.Errorf("reading tokens file: %w", err)
+	}
+	if err := yaml.Unmarshal(data, &tf); err != nil {
+		return tf, fmt.Errorf("parsing tokens file: %w", err)
+	}
+	return tf, nil
+}
+
+// writeTokensFile writes tf atomically with owner-only permissions.
+func writeTokensFile(path string, tf tokensFile) error {
+	data, err := yaml.Marshal(tf)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// newTokenSecret returns a random secret and its hex SHA-256 hash.
+func newTokenSecret() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret := "ccd_" + base64.RawURLEncoding.EncodeToString(b)
+	sum := sha256.Sum256([]byte(secret))
+	return secret, hex.EncodeToString(sum[:]), nil
+}
+
+// requestToken extracts the bearer token from the Authorization header or,
+// for WebSocket clients that can't set headers, the token query parameter.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p *principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
 
-	// Check query parameter (for WebSocket clients that can't set headers)
-	if r.URL.Query().Get("token") == token {
+// principalFrom returns the principal requireAuth attached to r.
+func principalFrom(r *http.Request) *principal {
+	if p, ok := r.Context().Value(principalKey{}).(*principal); ok {
+		return p
+	}
+	return anonymous
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+// runTokenCommand implements `ccdash-agent token mint|revoke|list`, which
+// manages the tokens file. A running agent picks up changes on the next
+// request; revoked tokens also drop their open connections.
+func runTokenCommand(args []string) int {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "usage: ccdash-agent token mint -name name [-role role] [-workdir dir]... [-ttl duration]")
+		fmt.Fprintln(os.Stderr, "       ccdash-agent token revoke name")
+		fmt.Fprintln(os.Stderr, "       ccdash-agent token list")
+		fmt.Fprintln(os.Stderr, "All subcommands accept -config path.")
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+
+	fs := flag.NewFlagSet("token "+args[0], flag.ExitOnError)
+	configPath := fs.String("config", defaultConfigPath(), "Path to config file")
+	name := fs.String("name", "", "Token name, recorded as the creator of sessions it starts")
+	role := fs.String("role", string(RoleOperator), "viewer, operator or admin")
+	ttl := fs.Duration("ttl", 0, "Expire the token after this long (e.g. 720h); 0 never expires")
+	var workdirs stringList
+	fs.Var(&workdirs, "workdir", "Restrict the token to this workdir (repeatable)")
+	fs.Parse(args[1:])
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+	path := expandPath(cfg.TokensFile)
+	tf, err := readTokensFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch args[0] {
+	case "mint":
+		if *name == "" {
+			usage()
+			return 2
+		}
+		if _, ok := roleRank[Role(*role)]; !ok {
+			fmt.Fprintf(os.Stderr, "Unknown role %q\n", *role)
+			return 2
+		}
+		for _, t := range append(append([]TokenConfig{}, cfg.Tokens...), tf.Tokens...) {
+			if t.Name == *name {
+				fmt.Fprintf(os.Stderr, "Token %q already exists\n", *name)
+				return 1
+			}
+		}
+		secret, hash, err := newTokenSecret()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to generate token: %v\n", err)
+			return 1
+		}
+		t := TokenConfig{Name: *name, Hash: hash, Role: Role(*role), Workdirs: workdirs}
+		if *ttl > 0 {
+			t.Expires = time.Now().Add(*ttl).UTC().Truncate(time.Second)
+		}
+		tf.Tokens = append(tf.Tokens, t)
+		if err := writeTokensFile(path, tf); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write tokens file: %v\n", err)
+			return 1
+		}
+		fmt.Println(secret)
+		fmt.Fprintln(os.Stderr, "Store this token now; only its hash is kept.")
+
+	case "revoke":
+		if fs.NArg() != 1 {
+			usage()
+			return 2
+		}
+		kept := tf.Tokens[:0]
+		for _, t := range tf.Tokens {
+			if t.Name != fs.Arg(0) {
+				kept = append(kept, t)
+			}
+		}
+		if len(kept) == len(tf.Tokens) {
+			fmt.Fprintf(os.Stderr, "No token %q in %s\n", fs.Arg(0), path)
+			return 1
+		}
+		tf.Tokens = kept
+		if err := writeTokensFile(path, tf); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write tokens file: %v\n", err)
+			return 1
+		}
+
+	case "list":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tROLE\tWORKDIRS\tEXPIRES\tSOURCE")
+		list := func(tokens []TokenConfig, source string) {
+			for _, t := range tokens {
+				expires := "never"
+				if !t.Expires.IsZero() {
+					expires = t.Expires.Format(time.RFC3339)
+				}
+				dirs := strings.Join(t.Workdirs, ",")
+				if dirs == "" {
+					dirs = "*"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.Name, t.Role, dirs, expires, source)
+			}
+		}
+		if cfg.Token != "" {
+			fmt.Fprintln(w, "default\tadmin\t*\tnever\tconfig (token)")
+		}
+		list(cfg.Tokens, "config")
+		list(tf.Tokens, path)
+		w.Flush()
+
+	default:
+		usage()
+		return 2
+	}
+	return 0
+}
+
+// canAccessSession reports whether p may see and act on a session. Scoped
+// principals are denied unknown sessions rather than told they don't exist.
+func (s *Server) canAccessSession(p *principal, sessionID string) bool {
+	if len(p.Workdirs) == 0 {
 		return true
 	}
+	info, ok := s.poller.GetSession(sessionID)
+	return ok && p.canSee(info)
+}
 
-	return false
+// canAccessSessions reports whether p may act on every session msg names.
+func (s *Server) canAccessSessions(p *principal, msg ClientMessage) bool {
+	for _, id := range append([]string{msg.SessionID}, msg.SessionIDs...) {
+		if id != "" && !s.canAccessSession(p, id) {
+			return false
+		}
+	}
+	return true
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -11,29 +12,131 @@ import (
 type Config struct {
 	Bind         string   `yaml:"bind"`
 	Port         int      `yaml:"port"`
-	Token        string   `yaml:"token"`
+	Token        string   `yaml:"token"` // legacy shared secret, treated as an admin token
 	Workdirs     []string `yaml:"workdirs"`
 	HistoryLimit int      `yaml:"history_limit"`
+	Hooks        bool     `yaml:"hooks"`       // install Claude Code hooks for state detection
+	HookSocket   string   `yaml:"hook_socket"` // unix socket hook events are sent to
+
+	// Named tokens with a role and optional workdir scope and expiry. The
+	// tokens file is managed by `ccdash-agent token` and re-read on change.
+	Tokens     []TokenConfig `yaml:"tokens"`
+	TokensFile string        `yaml:"tokens_file"`
+
+	// Audit log of control actions (JSON lines), rotated at
+	// audit_max_size_mb keeping audit_keep old files.
+	AuditLog       string `yaml:"audit_log"`
+	AuditMaxSizeMB int    `yaml:"audit_max_size_mb"`
+	AuditKeep      int    `yaml:"audit_keep"`
+
+	// Record session output as asciicast files. Finished recordings are
+	// pruned beyond recordings_max_mb in total or recordings_max_age.
+	RecordSessions   bool          `yaml:"record_sessions"`
+	RecordingsDir    string        `yaml:"recordings_dir"`
+	RecordingsMaxMB  int           `yaml:"recordings_max_mb"`
+	RecordingsMaxAge time.Duration `yaml:"recordings_max_age"`
+
+	// Cost accounting: pricing overrides (USD per million tokens, matched
+	// by model ID prefix), the window for per-workdir cost, and budgets.
+	Pricing    map[string]ModelPricing `yaml:"pricing"`
+	CostWindow time.Duration           `yaml:"cost_window"`
+	Budgets    []Budget                `yaml:"budgets"`
+
+	// Usage is read for live sessions' workdirs, or with usage_scan_all
+	// for every project under ~/.claude/projects. usage_include and
+	// usage_exclude limit either by workdir (the dir and everything below).
+	UsageScanAll bool     `yaml:"usage_scan_all"`
+	UsageInclude []string `yaml:"usage_include"`
+	UsageExclude []string `yaml:"usage_exclude"`
+
+	// Stream tool calls, prompts and errors read from Claude transcripts
+	// as transcript_events. Off by default: it reveals what sessions do.
+	TranscriptEvents bool `yaml:"transcript_events"`
+
+	// Include each conversation's first prompt in list_conversations. Off
+	// by default for the same reason.
+	ConversationPrompts bool `yaml:"conversation_prompts"`
+
+	// Mount points the metrics message reports; empty: every non-virtual
+	// filesystem (just / on macOS).
+	MetricsFilesystems []string `yaml:"metrics_filesystems"`
+
+	// How long metrics_history keeps one-minute averages, and whether they
+	// are saved to disk to survive restarts.
+	MetricsHistory        time.Duration `yaml:"metrics_history"`
+	MetricsHistoryPersist bool          `yaml:"metrics_history_persist"`
+
+	// Serve /metrics (Prometheus) without a token. Otherwise it needs a
+	// viewer token without a workdir scope, as a bearer token.
+	MetricsPublic bool `yaml:"metrics_public"`
+
+	// TLS for the listener. tls_auto generates a self-signed certificate
+	// when tls_cert is unset; client_ca additionally requires client certs.
+	TLSCert  string `yaml:"tls_cert"`
+	TLSKey   string `yaml:"tls_key"`
+	TLSAuto  bool   `yaml:"tls_auto"`
+	ClientCA string `yaml:"client_ca"`
+
+	// State detection rules, hot-reloaded on change. A rules file takes
+	// precedence over inline rules; with neither, built-in rules apply.
+	StateRules     []StateRule `yaml:"state_rules"`
+	StateRulesFile string      `yaml:"state_rules_file"`
+
+	// Named launch profiles for create_session and extra detector rule
+	// sets they can reference. Built-in: profiles claude/shell, detectors
+	// claude/shell.
+	Profiles map[string]LaunchProfile `yaml:"profiles"`
+	RuleSets map[string][]StateRule   `yaml:"rule_sets"`
 }
 
 func (c *Config) ExpandWorkdirs() []string {
-	var expanded []string
-	for _, d := range c.Workdirs {
-		if len(d) > 0 && d[0] == '~' {
-			home, _ := os.UserHomeDir()
-			d = filepath.Join(home, d[1:])
-		}
-		expanded = append(expanded, d)
+	return expandPaths(c.Workdirs)
+}
+
+func expandPaths(paths []string) []string {
+	expanded := []string{}
+	for _, d := range paths {
+		expanded = append(expanded, expandPath(d))
 	}
 	return expanded
 }
 
+// expandPath expands a leading ~ to the user's home directory.
+func expandPath(p string) string {
+	if len(p) > 0 && p[0] == '~' {
+		home, _ := os.UserHomeDir()
+		p = filepath.Join(home, p[1:])
+	}
+	return p
+}
+
+// agentDataDir is where the agent keeps its config and state.
+func agentDataDir() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".claude-dashboard")
+}
+
+func defaultConfigPath() string {
+	return filepath.Join(agentDataDir(), "agent.yaml")
+}
+
 func defaultConfig() *Config {
 	return &Config{
-		Port:         9100,
-		Token:        "",
-		Workdirs:     []string{},
-		HistoryLimit: 50000,
+		Port:             9100,
+		Token:            "",
+		Workdirs:         []string{},
+		HistoryLimit:     50000,
+		Hooks:            true,
+		HookSocket:       defaultHookSocket(),
+		TokensFile:       defaultTokensFile(),
+		AuditLog:         defaultAuditLogPath(),
+		AuditMaxSizeMB:   10,
+		AuditKeep:        5,
+		RecordingsDir:    defaultRecordingsDir(),
+		RecordingsMaxMB:  1024,
+		RecordingsMaxAge: 30 * 24 * time.Hour,
+		CostWindow:       24 * time.Hour,
+		MetricsHistory:   24 * time.Hour,
 	}
 }
 
@@ -58,6 +161,30 @@ func loadConfig(path string) (*Config, error) {
 	if cfg.HistoryLimit == 0 {
 		cfg.HistoryLimit = 50000
 	}
+	if cfg.HookSocket == "" {
+		cfg.HookSocket = defaultHookSocket()
+	}
+	if cfg.TokensFile == "" {
+		cfg.TokensFile = defaultTokensFile()
+	}
+	if cfg.AuditLog == "" {
+		cfg.AuditLog = defaultAuditLogPath()
+	}
+	if cfg.AuditMaxSizeMB <= 0 {
+		cfg.AuditMaxSizeMB = 10
+	}
+	if cfg.RecordingsDir == "" {
+		cfg.RecordingsDir = defaultRecordingsDir()
+	}
+	if cfg.CostWindow <= 0 {
+		cfg.CostWindow = 24 * time.Hour
+	}
+	if cfg.MetricsHistory <= 0 {
+		cfg.MetricsHistory = 24 * time.Hour
+	}
+	if err := validateBudgets(cfg.Budgets); err != nil {
+		return nil, err
+	}
 
 	return cfg, nil
 }
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ConversationInfo describes a past Claude conversation, read from its JSONL
+// transcript.
+type ConversationInfo struct {
+	ID           string  `json:"id"` // Claude session ID, for resume_conversation
+	Workdir      string  `json:"workdir"`
+	Summary      string  `json:"summary,omitempty"`      // title Claude gave it, if any
+	FirstPrompt  string  `json:"first_prompt,omitempty"` // shortened
+	StartedAt    string  `json:"started_at"`
+	LastActivity string  `json:"last_activity"`
+	Tokens       int     `json:"tokens"` // all kinds, subagents included
+	Cost         float64 `json:"cost"`
+	Messages     int     `json:"messages"`             // assistant messages with usage
+	SessionID    string  `json:"session_id,omitempty"` // tmux session running it now
+}
+
+// ConversationsMessage answers list_conversations.
+type ConversationsMessage struct {
+	Type          string             `json:"type"`
+	Conversations []ConversationInfo `json:"conversations"`
+}
+
+const (
+	defaultConversationLimit = 50
+	maxFirstPrompt           = 200 // runes of the first prompt kept
+)
+
+var (
+	errConversationNotFound = errors.New("conversation not found")
+	errConversationWorkdir  = errors.New("conversation was started in another workdir")
+	errResumeNeedsClaude    = errors.New("resuming a conversation needs a claude profile")
+)
+
+// conversationIndex summarizes transcripts for list_conversations, caching
+// each summary until the transcript or its subagent files change.
+type conversationIndex struct {
+	pricing pricingTable
+
+	mu    sync.Mutex
+	cache map[string]cachedConversation // transcript path -> summary
+}
+
+type cachedConversation struct {
+	stamp string // sizes and mtimes of the files read
+	info  ConversationInfo
+	ok    bool
+}
+
+func newConversationIndex(pricing pricingTable) *conversationIndex {
+	return &conversationIndex{pricing: pricing, cache: make(map[string]cachedConversation)}
+}
+
+// list summarizes the conversations in a project folder.
+func (c *conversationIndex) list(dir, workdir string) []ConversationInfo {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	var result []ConversationInfo
+	for _, path := range files {
+		if info, ok := c.get(path, workdir); ok {
+			result = append(result, info)
+		}
+	}
+	return result
+}
+
+func (c *conversationIndex) get(path, workdir string) (ConversationInfo, bool) {
+	subFiles, _ := filepath.Glob(filepath.Join(strings.TrimSuffix(path, ".jsonl"), "subagents", "*.jsonl"))
+	files := append([]string{path}, subFiles...)
+	var stamp strings.Builder
+	for _, f := range files {
+		if st, err := os.Stat(f); err == nil {
+			fmt.Fprintf(&stamp, "%s %d %d\n", f, st.Size(), st.ModTime().UnixNano())
+		}
+	}
+
+	c.mu.Lock()
+	cached, hit := c.cache[path]
+	c.mu.Unlock()
+	if hit && cached.stamp == stamp.String() {
+		return cached.info, cached.ok
+	}
+
+	info := ConversationInfo{ID: strings.TrimSuffix(filepath.Base(path), ".jsonl"), Workdir: workdir}
+	for i, f := range files {
+		c.read(&info, f, workdir, i == 0)
+	}
+	// Files with neither a prompt nor a reply are aborted starts.
+	ok := info.FirstPrompt != "" || info.Messages > 0
+	c.mu.Lock()
+	c.cache[path] = cachedConversation{stamp: stamp.String(), info: info, ok: ok}
+	c.mu.Unlock()
+	return info, ok
+}
+
+// read adds one transcript file to info. Only the main transcript supplies
+// the summary, first prompt and start time; subagent files add usage.
+func (c *conversationIndex) read(info *ConversationInfo, path, workdir string, main bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	// ReadBytes rather than a Scanner, which gives up on a line over its
+	// buffer; a long tool result shouldn't cut the transcript short.
+	r := bufio.NewReaderSize(f, 256*1024)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && len(line) == 0 {
+			if err != io.EOF {
+				log.Printf("conversations: %s: %v", path, err)
+			}
+			return
+		}
+		if entry, ok := parseUsageLine(line, workdir); ok {
+			info.Tokens += entry.InputTokens + entry.OutputTokens + entry.CacheCreationInputTokens + entry.CacheReadInputTokens
+			info.Cost += c.pricing.cost(entry)
+			info.Messages++
+			if entry.Timestamp > info.LastActivity {
+				info.LastActivity = entry.Timestamp
+			}
+		}
+		if !main {
+			continue
+		}
+
+		var tl transcriptLine
+		if json.Unmarshal(line, &tl) != nil {
+			continue
+		}
+		if tl.Type == "summary" {
+			info.Summary = tl.Summary
+			continue
+		}
+		if tl.Timestamp != "" {
+			if info.StartedAt == "" {
+				info.StartedAt = tl.Timestamp
+			}
+			info.LastActivity = tl.Timestamp
+		}
+		if tl.Type == "user" && !tl.IsMeta && tl.Message != nil && info.FirstPrompt == "" {
+			info.FirstPrompt = promptText(tl.Message.Content)
+		}
+	}
+}
+
+// promptText is a user message's typed text, whitespace collapsed and
+// shortened, or "" for tool results and the wrappers slash commands log.
+func promptText(content json.RawMessage) string {
+	text := strings.Join(strings.Fields(contentText(content)), " ")
+	if strings.HasPrefix(text, "<") || strings.HasPrefix(text, "Caveat:") {
+		return ""
+	}
+	if short := truncateUTF8(text, maxFirstPrompt); short != text {
+		return short + "…"
+	}
+	return text
+}
+
+// listConversations returns the conversations p may see, most recently
+// active first: those of workdir if given, whether or not a session runs
+// there, else of every scanned project within the configured workdirs.
+// First prompts are left out unless conversation_prompts is on, since they
+// reveal what sessions do.
+func (s *Server) listConversations(p *principal, workdir string, limit int) ([]ConversationInfo, error) {
+	projects := s.usage.projects()
+	if workdir != "" {
+		workdir = filepath.Clean(expandPath(workdir))
+		if !s.isAllowedWorkdir(workdir) || !p.inScope(workdir) {
+			return nil, errWorkdirNotAllowed
+		}
+		projects = nil
+		if dir := projectFolder(s.usage, workdir); dir != "" {
+			projects = []usageProject{{dir: dir, workdir: workdir}}
+		}
+	}
+
+	running := make(map[string]string) // conversation -> tmux session
+	for _, info := range s.poller.GetSessions() {
+		for _, id := range info.ClaudeSessionIDs {
+			running[id] = info.ID
+		}
+	}
+
+	result := []ConversationInfo{}
+	for _, project := range projects {
+		if !s.isAllowedWorkdir(project.workdir) || !p.inScope(project.workdir) {
+			continue
+		}
+		for _, conv := range s.conversations.list(project.dir, project.workdir) {
+			conv.SessionID = running[conv.ID]
+			if !s.config.ConversationPrompts {
+				conv.FirstPrompt = ""
+			}
+			result = append(result, conv)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastActivity > result[j].LastActivity
+	})
+	if limit <= 0 {
+		limit = defaultConversationLimit
+	}
+	return result[:min(len(result), limit)], nil
+}
+
+// projectFolder returns the ~/.claude/projects folder of workdir: the one
+// named after it or, failing that, one whose transcripts record it as their
+// cwd. "" means Claude has never run there.
+func projectFolder(u *UsageScanner, workdir string) string {
+	root := usageProjectsRoot()
+	if root == "" {
+		return ""
+	}
+	dir := filepath.Join(root, workdirToFolder(workdir))
+	if st, err := os.Stat(dir); err == nil && st.IsDir() {
+		return dir
+	}
+	dirs, _ := filepath.Glob(filepath.Join(root, "*"))
+	for _, dir := range dirs {
+		if cwd := u.folderWorkdir(dir); cwd != "" && filepath.Clean(cwd) == workdir {
+			return dir
+		}
+	}
+	return ""
+}
+
+// conversationWorkdir finds a conversation's transcript in any project
+// folder and returns the workdir it was started in.
+func (s *Server) conversationWorkdir(id string) (string, error) {
+	if id == "" || strings.Trim(id, "0123456789abcdefABCDEF-") != "" {
+		return "", errConversationNotFound
+	}
+	root := usageProjectsRoot()
+	if root == "" {
+		return "", errConversationNotFound
+	}
+	matches, _ := filepath.Glob(filepath.Join(root, "*", id+".jsonl"))
+	for _, path := range matches {
+		if workdir := firstCwd(path); workdir != "" {
+			return workdir, nil
+		}
+	}
+	return "", errConversationNotFound
+}
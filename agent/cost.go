@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ModelPricing is USD per million tokens.
+type ModelPricing struct {
+	Input       float64 `yaml:"input"`
+	Output      float64 `yaml:"output"`
+	CacheCreate float64 `yaml:"cache_create"`
+	CacheRead   float64 `yaml:"cache_read"`
+}
+
+// builtinPricing mirrors the dashboard's table. Keys match model IDs by
+// prefix, longest first, so dated IDs resolve to their family.
+var builtinPricing = map[string]ModelPricing{
+	"claude-opus-4-6":   {Input: 5, Output: 25, CacheCreate: 6.25, CacheRead: 0.50},
+	"claude-opus-4-5":   {Input: 5, Output: 25, CacheCreate: 6.25, CacheRead: 0.50},
+	"claude-opus-4-1":   {Input: 15, Output: 75, CacheCreate: 18.75, CacheRead: 1.50},
+	"claude-opus-4-":    {Input: 15, Output: 75, CacheCreate: 18.75, CacheRead: 1.50},
+	"claude-sonnet-4-6": {Input: 3, Output: 15, CacheCreate: 3.75, CacheRead: 0.30},
+	"claude-sonnet-4-5": {Input: 3, Output: 15, CacheCreate: 3.75, CacheRead: 0.30},
+	"claude-sonnet-4-":  {Input: 3, Output: 15, CacheCreate: 3.75, CacheRead: 0.30},
+	"claude-haiku-4-5":  {Input: 1, Output: 5, CacheCreate: 1.25, CacheRead: 0.10},
+	"claude-haiku-3-5":  {Input: 0.80, Output: 4, CacheCreate: 1.00, CacheRead: 0.08},
+}
+
+// defaultPricingModel prices unknown models, as the dashboard does.
+const defaultPricingModel = "claude-sonnet-4-6"
+
+// pricingTable resolves model IDs to prices: config entries override the
+// built-in ones.
+type pricingTable struct {
+	prices map[string]ModelPricing
+	keys   []string // longest first
+}
+
+func newPricingTable(overrides map[string]ModelPricing) pricingTable {
+	t := pricingTable{prices: make(map[string]ModelPricing)}
+	for k, v := range builtinPricing {
+		t.prices[k] = v
+	}
+	for k, v := range overrides {
+		t.prices[k] = v
+	}
+	for k := range t.prices {
+		t.keys = append(t.keys, k)
+	}
+	sort.Slice(t.keys, func(i, j int) bool { return len(t.keys[i]) > len(t.keys[j]) })
+	return t
+}
+
+func (t pricingTable) lookup(model string) ModelPricing {
+	if p, ok := t.prices[model]; ok {
+		return p
+	}
+	for _, k := range t.keys {
+		if strings.HasPrefix(model, k) {
+			return t.prices[k]
+		}
+	}
+	return t.prices[defaultPricingModel]
+}
+
+// cost returns the USD cost of one usage entry.
+func (t pricingTable) cost(e UsageEntry) float64 {
+	p := t.lookup(e.Model)
+	return (float64(e.InputTokens)*p.Input +
+		float64(e.OutputTokens)*p.Output +
+		float64(e.CacheCreationInputTokens)*p.CacheCreate +
+		float64(e.CacheReadInputTokens)*p.CacheRead) / 1e6
+}
+
+// Budget actions, from mildest to harshest.
+const (
+	budgetActionFlag      = "flag"      // mark the session needs_attention
+	budgetActionInterrupt = "interrupt" // also send Escape to stop Claude's turn
+	budgetActionKill      = "kill"      // kill the session
+)
+
+// Budget is a spend limit. Scope "session" compares each session's cost to
+// the limit; scope "workdir" compares the workdir's cost over cost_window.
+type Budget struct {
+	Name     string  `yaml:"name"`
+	Workdir  string  `yaml:"workdir"` // only sessions in or below this dir; empty: all
+	Scope    string  `yaml:"scope"`   // session (default) or workdir
+	LimitUSD float64 `yaml:"limit_usd"`
+	Action   string  `yaml:"action"` // flag (default), interrupt or kill
+}
+
+func (b Budget) spent(info *SessionInfo) float64 {
+	if b.Scope == "workdir" {
+		return info.WorkdirCost
+	}
+	return info.Cost
+}
+
+func (b Budget) applies(info *SessionInfo) bool {
+	return b.Workdir == "" || workdirWithin(info.Workdir, []string{expandPath(b.Workdir)})
+}
+
+// validateBudgets checks budgets and fills in defaults.
+func validateBudgets(budgets []Budget) error {
+	for i := range budgets {
+		b := &budgets[i]
+		if b.Name == "" {
+			b.Name = fmt.Sprintf("budget-%d", i+1)
+		}
+		if b.LimitUSD <= 0 {
+			return fmt.Errorf("budget %q: limit_usd must be positive", b.Name)
+		}
+		switch b.Scope {
+		case "":
+			b.Scope = "session"
+		case "session", "workdir":
+		default:
+			return fmt.Errorf("budget %q: unknown scope %q", b.Name, b.Scope)
+		}
+		switch b.Action {
+		case "":
+			b.Action = budgetActionFlag
+		case budgetActionFlag, budgetActionInterrupt, budgetActionKill:
+		default:
+			return fmt.Errorf("budget %q: unknown action %q", b.Name, b.Action)
+		}
+	}
+	return nil
+}
+
+// conversationCost is the running cost and usage of one Claude conversation
+// (the session_id in its JSONL log).
+type conversationCost struct {
+	firstAt time.Time
+	total   float64
+	usage   SessionUsage
+}
+
+// modelTotal is the usage and cost of every entry counted for one model.
+type modelTotal struct {
+	usage SessionUsage
+	cost  float64
+}
+
+// maxSeen bounds the entries costTracker remembers having counted.
+const maxSeen = 100000
+
+type timedCost struct {
+	at   time.Time
+	cost float64
+}
+
+// costTracker accumulates the cost of usage entries as the scanner finds
+// them and attributes it to sessions.
+type costTracker struct {
+	pricing pricingTable
+	window  time.Duration
+
+	mu       sync.Mutex
+	seen     map[string]bool                         // requestID/uuid already counted
+	seenPrev map[string]bool                         // the generation before seen
+	convs    map[string]map[string]*conversationCost // workdir -> conversation -> cost
+	recent   map[string][]timedCost                  // workdir -> entries within window
+	models   map[string]*modelTotal                  // model -> totals, for /metrics
+}
+
+func newCostTracker(pricing pricingTable, window time.Duration) *costTracker {
+	return &costTracker{
+		pricing: pricing,
+		window:  window,
+		seen:    make(map[string]bool),
+		convs:   make(map[string]map[string]*conversationCost),
+		recent:  make(map[string][]timedCost),
+		models:  make(map[string]*modelTotal),
+	}
+}
+
+// price sets Cost on entries without counting them.
+func (c *costTracker) price(entries []UsageEntry) {
+	for i := range entries {
+		entries[i].Cost = c.pricing.cost(entries[i])
+	}
+}
+
+// Add prices entries in place and counts each one once, however often the
+// scanner re-reads it.
+func (c *costTracker) Add(entries []UsageEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range entries {
+		e := &entries[i]
+		e.Cost = c.pricing.cost(*e)
+
+		key := e.key()
+		if c.seen[key] || c.seenPrev[key] {
+			continue
+		}
+		c.markSeen(key)
+
+		usage := SessionUsage{
+			InputTokens:              e.InputTokens,
+			OutputTokens:             e.OutputTokens,
+			CacheCreationInputTokens: e.CacheCreationInputTokens,
+			CacheReadInputTokens:     e.CacheReadInputTokens,
+			Messages:                 1,
+		}
+		model := c.models[e.Model]
+		if model == nil {
+			model = &modelTotal{}
+			c.models[e.Model] = model
+		}
+		model.usage.add(usage)
+		model.cost += e.Cost
+
+		at, err := time.Parse(time.RFC3339, e.Timestamp)
+		if err != nil {
+			continue
+		}
+		workdir := filepath.Clean(e.Workdir)
+		convs := c.convs[workdir]
+		if convs == nil {
+			convs = make(map[string]*conversationCost)
+			c.convs[workdir] = convs
+		}
+		conv := convs[e.SessionID]
+		if conv == nil {
+			conv = &conversationCost{firstAt: at}
+			convs[e.SessionID] = conv
+		}
+		if at.Before(conv.firstAt) {
+			conv.firstAt = at
+		}
+		conv.total += e.Cost
+		conv.usage.add(usage)
+		if time.Since(at) < c.window {
+			c.recent[workdir] = append(c.recent[workdir], timedCost{at: at, cost: e.Cost})
+		}
+	}
+}
+
+// markSeen records key as counted. Keys are kept for the last maxSeen to
+// 2*maxSeen entries: repeats come from files re-read after a restart or
+// truncation and from resumed conversations copying their history, which
+// the scanner reaches long before that many other entries.
+func (c *costTracker) markSeen(key string) {
+	if len(c.seen) >= maxSeen {
+		c.seenPrev, c.seen = c.seen, make(map[string]bool)
+	}
+	c.seen[key] = true
+}
+
+// ModelTotals returns the usage and cost counted so far per model.
+func (c *costTracker) ModelTotals() map[string]modelTotal {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make(map[string]modelTotal, len(c.models))
+	for model, t := range c.models {
+		result[model] = *t
+	}
+	return result
+}
+
+// annotate sets Cost, Usage, ClaudeSessionIDs and WorkdirCost on every
+// session. A conversation belongs to the session whose hooks reported it;
+// failing that, to the newest session in its workdir created before it
+// began, among sessions without hooks (those report all their own).
+func (c *costTracker) annotate(sessions map[string]*SessionInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	byWorkdir := make(map[string][]*SessionInfo)
+	hookedBy := make(map[string]*SessionInfo) // conversation -> session
+	for _, info := range sessions {
+		info.Cost, info.WorkdirCost, info.Usage = 0, 0, SessionUsage{}
+		info.ClaudeSessionIDs = slices.Clone(info.hooked)
+		for _, id := range info.hooked {
+			hookedBy[id] = info
+		}
+		workdir := filepath.Clean(info.Workdir)
+		byWorkdir[workdir] = append(byWorkdir[workdir], info)
+	}
+
+	// Conversations attributed without hooks, per session.
+	attributed := make(map[*SessionInfo][]string)
+	for workdir, convs := range c.convs {
+		for id, conv := range convs {
+			owner := hookedBy[id]
+			if owner == nil {
+				for _, info := range byWorkdir[workdir] {
+					created := time.Unix(info.Created, 0)
+					if len(info.hooked) == 0 && !created.After(conv.firstAt) && (owner == nil || info.Created > owner.Created) {
+						owner = info
+					}
+				}
+				if owner != nil {
+					attributed[owner] = append(attributed[owner], id)
+				}
+			}
+			if owner != nil {
+				owner.Cost += conv.total
+				owner.Usage.add(conv.usage)
+			}
+		}
+	}
+	for info, ids := range attributed {
+		convs := c.convs[filepath.Clean(info.Workdir)]
+		sort.Slice(ids, func(i, j int) bool { return convs[ids[i]].firstAt.Before(convs[ids[j]].firstAt) })
+		info.ClaudeSessionIDs = append(info.ClaudeSessionIDs, ids...)
+	}
+
+	cutoff := time.Now().Add(-c.window)
+	for workdir, entries := range c.recent {
+		// Entries arrive in file order, not time order, so filter rather
+		// than trim.
+		recent := entries[:0]
+		var windowCost float64
+		for _, tc := range entries {
+			if !tc.at.Before(cutoff) {
+				recent = append(recent, tc)
+				windowCost += tc.cost
+			}
+		}
+		if len(recent) == 0 {
+			delete(c.recent, workdir)
+		} else {
+			c.recent[workdir] = recent
+		}
+
+		for _, info := range byWorkdir[workdir] {
+			info.WorkdirCost = windowCost
+		}
+	}
+}
+
+// enforceBudgets applies the first budget each session has crossed. A
+// budget fires once per crossing: it re-arms when spending drops back under
+// its limit, as a workdir budget's does when its window moves on. Actions
+// run in their own goroutine since this is called from the poller with its
+// lock held. sessions is every live session.
+func (s *Server) enforceBudgets(sessions []*SessionInfo) {
+	if len(s.config.Budgets) == 0 {
+		return
+	}
+	s.budgetMu.Lock()
+	defer s.budgetMu.Unlock()
+	live := make(map[string]bool, len(sessions))
+	for _, info := range sessions {
+		live[info.ID] = true
+		for _, b := range s.config.Budgets {
+			key := info.ID + "\x00" + b.Name
+			if !b.applies(info) || b.spent(info) < b.LimitUSD {
+				delete(s.budgetFired, key)
+				continue
+			}
+			if s.budgetFired[key] {
+				continue
+			}
+			s.budgetFired[key] = true
+			go s.applyBudget(b, info.ID, b.spent(info))
+			break
+		}
+	}
+	for key := range s.budgetFired {
+		if id, _, _ := strings.Cut(key, "\x00"); !live[id] {
+			delete(s.budgetFired, key)
+		}
+	}
+}
+
+func (s *Server) applyBudget(b Budget, sessionID string, spent float64) {
+	log.Printf("budget %q: session %s spent $%.2f (limit $%.2f), action %s", b.Name, sessionID, spent, b.LimitUSD, b.Action)
+	var err error
+	switch b.Action {
+	case budgetActionKill:
+		err = s.killSession(sessionID)
+	case budgetActionInterrupt:
+		s.poller.FlagBudget(sessionID, b.Name)
+		err = sendTmuxKeys(sessionID, "Escape")
+	default:
+		s.poller.FlagBudget(sessionID, b.Name)
+	}
+	s.audit.Record(AuditEvent{
+		Token:     "budget:" + b.Name,
+		Action:    "budget_" + b.Action,
+		SessionID: sessionID,
+		Detail:    fmt.Sprintf("$%.2f of $%.2f", spent, b.LimitUSD),
+		Outcome:   outcome(err),
+	})
+	if b.Action != budgetActionKill {
+		s.broadcastSessions(s.poller.GetSessions())
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+// usageAt is an entry of 1M input tokens of claude-sonnet-4-6 ($3).
+func usageAt(request, conversation, workdir string, at time.Time) UsageEntry {
+	return UsageEntry{
+		RequestID:   request,
+		UUID:        "u-" + request,
+		SessionID:   conversation,
+		Workdir:     workdir,
+		Model:       "claude-sonnet-4-6",
+		Timestamp:   at.UTC().Format(time.RFC3339),
+		InputTokens: 1e6,
+	}
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestPricingLookup(t *testing.T) {
+	table := newPricingTable(map[string]ModelPricing{"claude-sonnet-4-": {Input: 1}})
+	tests := []struct {
+		model string
+		input float64
+	}{
+		{"claude-opus-4-6", 5},
+		{"claude-opus-4-20250514", 15},    // family prefix
+		{"claude-sonnet-4-5-20250929", 3}, // longest prefix wins
+		{"claude-sonnet-4-20250514", 1},   // config override
+		{"some-other-model", 3},           // default model's price
+		{"claude-haiku-3-5-20241022", 0.80},
+	}
+	for _, tt := range tests {
+		if got := table.lookup(tt.model).Input; got != tt.input {
+			t.Errorf("lookup(%q).Input = %v, want %v", tt.model, got, tt.input)
+		}
+	}
+}
+
+func TestCostTrackerAddCountsOnce(t *testing.T) {
+	now := time.Now()
+	c := newCostTracker(newPricingTable(nil), time.Hour)
+
+	first := []UsageEntry{usageAt("r1", "conv", "/w", now), usageAt("r2", "conv", "/w", now)}
+	c.Add(first)
+	// A truncated or replayed file brings the same entries back.
+	again := []UsageEntry{usageAt("r1", "conv", "/w", now), usageAt("r2", "conv", "/w", now), usageAt("r3", "conv", "/w", now)}
+	c.Add(again)
+
+	for _, e := range again {
+		if !almostEqual(e.Cost, 3) {
+			t.Errorf("entry %s priced %v, want 3", e.RequestID, e.Cost)
+		}
+	}
+	total := c.ModelTotals()["claude-sonnet-4-6"]
+	if total.usage.Messages != 3 || !almostEqual(total.cost, 9) {
+		t.Errorf("model total = %d messages, $%v; want 3 messages, $9", total.usage.Messages, total.cost)
+	}
+	if conv := c.convs["/w"]["conv"]; conv == nil || !almostEqual(conv.total, 9) || conv.usage.InputTokens != 3e6 {
+		t.Errorf("conversation cost = %+v, want $9 and 3M input tokens", conv)
+	}
+}
+
+func TestCostTrackerSeenGenerations(t *testing.T) {
+	c := newCostTracker(newPricingTable(nil), time.Hour)
+	c.markSeen("old")
+	for i := range maxSeen {
+		c.markSeen(fmt.Sprint(i))
+	}
+	// "old" moved to the previous generation and still counts as seen.
+	if !c.seenPrev["old"] || len(c.seen) > maxSeen {
+		t.Fatalf("after %d keys: old in seenPrev = %v, len(seen) = %d", maxSeen+1, c.seenPrev["old"], len(c.seen))
+	}
+	for i := range maxSeen {
+		c.markSeen(fmt.Sprint("new", i))
+	}
+	if c.seen["old"] || c.seenPrev["old"] {
+		t.Errorf("old still remembered two generations later")
+	}
+}
+
+func TestCostTrackerWorkdirWindow(t *testing.T) {
+	now := time.Now()
+	c := newCostTracker(newPricingTable(nil), time.Hour)
+	c.Add([]UsageEntry{
+		usageAt("old", "conv", "/w", now.Add(-2*time.Hour)),
+		usageAt("new", "conv", "/w/", now.Add(-time.Minute)),
+		usageAt("other", "conv2", "/x", now),
+	})
+
+	sessions := map[string]*SessionInfo{
+		"s": {ID: "s", Workdir: "/w", Created: now.Add(-3 * time.Hour).Unix()},
+	}
+	c.annotate(sessions)
+	s := sessions["s"]
+	if !almostEqual(s.Cost, 6) {
+		t.Errorf("Cost = %v, want 6 (both entries of its conversation)", s.Cost)
+	}
+	if !almostEqual(s.WorkdirCost, 3) {
+		t.Errorf("WorkdirCost = %v, want 3 (only the entry within the window)", s.WorkdirCost)
+	}
+}
+
+func TestCostTrackerAnnotateAttribution(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	c := newCostTracker(newPricingTable(nil), time.Hour)
+	c.Add([]UsageEntry{
+		usageAt("r0", "before-all", "/w", now.Add(-4*time.Hour)),
+		usageAt("r1", "early", "/w", now.Add(-150*time.Minute)),
+		usageAt("r2", "late", "/w", now.Add(-30*time.Minute)),
+		usageAt("r3", "late", "/w", now.Add(-20*time.Minute)),
+		usageAt("r4", "hooked", "/w", now.Add(-10*time.Minute)),
+		usageAt("r5", "elsewhere", "/x", now.Add(-10*time.Minute)),
+	})
+
+	sessions := map[string]*SessionInfo{
+		"a": {ID: "a", Workdir: "/w", Created: now.Add(-3 * time.Hour).Unix()},
+		"b": {ID: "b", Workdir: "/w", Created: now.Add(-time.Hour).Unix()},
+		// Newest before "late" began, but its hooks report its own.
+		"c": {ID: "c", Workdir: "/w", Created: now.Add(-40 * time.Minute).Unix(), hooked: []string{"hooked"}},
+	}
+	c.annotate(sessions)
+
+	tests := []struct {
+		session string
+		convs   []string
+		cost    float64
+	}{
+		{"a", []string{"early"}, 3},
+		{"b", []string{"late"}, 6},
+		{"c", []string{"hooked"}, 3},
+	}
+	for _, tt := range tests {
+		info := sessions[tt.session]
+		if !slices.Equal(info.ClaudeSessionIDs, tt.convs) {
+			t.Errorf("session %s conversations = %q, want %q", tt.session, info.ClaudeSessionIDs, tt.convs)
+		}
+		if !almostEqual(info.Cost, tt.cost) || info.Usage.Messages != int(tt.cost/3) {
+			t.Errorf("session %s cost = %v over %d messages, want %v", tt.session, info.Cost, info.Usage.Messages, tt.cost)
+		}
+	}
+
+	// Annotating again starts from scratch rather than adding up.
+	c.annotate(sessions)
+	if !almostEqual(sessions["b"].Cost, 6) || len(sessions["b"].ClaudeSessionIDs) != 1 {
+		t.Errorf("second annotate: b cost = %v, conversations %q", sessions["b"].Cost, sessions["b"].ClaudeSessionIDs)
+	}
+}
+
+func TestCostTrackerAnnotateOrdersConversations(t *testing.T) {
+	now := time.Now()
+	c := newCostTracker(newPricingTable(nil), time.Hour)
+	c.Add([]UsageEntry{
+		usageAt("r2", "second", "/w", now.Add(-10*time.Minute)),
+		usageAt("r1", "first", "/w", now.Add(-20*time.Minute)),
+		usageAt("r3", "third", "/w", now.Add(-5*time.Minute)),
+	})
+	sessions := map[string]*SessionInfo{
+		"s": {ID: "s", Workdir: "/w", Created: now.Add(-time.Hour).Unix(), hooked: []string{"resumed"}},
+		"t": {ID: "t", Workdir: "/w", Created: now.Add(-time.Hour).Unix()},
+	}
+	c.annotate(sessions)
+	if got := sessions["t"].ClaudeSessionIDs; !slices.Equal(got, []string{"first", "second", "third"}) {
+		t.Errorf("conversations = %q, want them in the order they began", got)
+	}
+	if got := sessions["s"].ClaudeSessionIDs; !slices.Equal(got, []string{"resumed"}) {
+		t.Errorf("hooked session conversations = %q, want only its own", got)
+	}
+}
@@ -3,7 +3,7 @@ module github.com/oleksiiilienko/claude-dashboard/agent
 go 1.25.7
 
 require (
-	github.com/creack/pty v1.1.24 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	github.com/creack/pty v1.1.24
+	github.com/gorilla/websocket v1.5.3
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Claude Code hook events we subscribe to, mapped to the state they imply.
+// Notification is special-cased: idle prompts mean idle, anything else
+// (permission requests, elicitation) needs attention.
+var hookEventStates = map[string]SessionState{
+	"SessionStart":     StateIdle,
+	"UserPromptSubmit": StateWorking,
+	"PreToolUse":       StateWorking,
+	"PostToolUse":      StateWorking,
+	"Notification":     StateNeedsAttention,
+	"Stop":             StateIdle,
+}
+
+// hookPayload is the subset of the JSON Claude Code writes to a hook's stdin.
+type hookPayload struct {
+	SessionID        string `json:"session_id"`
+	HookEventName    string `json:"hook_event_name"`
+	NotificationType string `json:"notification_type"`
+	Message          string `json:"message"`
+}
+
+func (h hookPayload) state() (SessionState, bool) {
+	if h.HookEventName == "Notification" && h.NotificationType == "idle_prompt" {
+		return StateIdle, true
+	}
+	state, ok := hookEventStates[h.HookEventName]
+	return state, ok
+}
+
+func defaultHookSocket() string {
+	return filepath.Join(agentDataDir(), "agent.sock")
+}
+
+func hookSettingsDir() string {
+	return filepath.Join(agentDataDir(), "hooks")
+}
+
+// hookReceiver accepts hook events from `ccdash-agent hook` over a unix
+// socket and feeds them to the poller as authoritative state.
+type hookReceiver struct {
+	socketPath string
+	poller     *Poller
+	listener   net.Listener
+}
+
+func newHookReceiver(socketPath string, poller *Poller) *hookReceiver {
+	return &hookReceiver{socketPath: socketPath, poller: poller}
+}
+
+func (h *hookReceiver) Start() error {
+	if err := os.MkdirAll(filepath.Dir(h.socketPath), 0700); err != nil {
+		return fmt.Errorf("creating socket dir: %w", err)
+	}
+	// A previous agent that died uncleanly leaves the socket file behind.
+	os.Remove(h.socketPath)
+
+	l, err := net.Listen("unix", h.socketPath)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", h.socketPath, err)
+	}
+	if err := os.Chmod(h.socketPath, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("chmod %s: %w", h.socketPath, err)
+	}
+	h.listener = l
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hook", h.handleHook)
+	go http.Serve(l, mux)
+	return nil
+}
+
+func (h *hookReceiver) Stop() {
+	if h.listener != nil {
+		h.listener.Close()
+		os.Remove(h.socketPath)
+	}
+}
+
+func (h *hookReceiver) handleHook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := r.URL.Query().Get("session")
+	if sessionID == "" {
+		http.Error(w, "session required", http.StatusBadRequest)
+		return
+	}
+
+	var payload hookPayload
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&payload); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	if payload.SessionID != "" {
+		h.poller.LinkConversation(sessionID, payload.SessionID)
+	}
+	if state, ok := payload.state(); ok {
+		h.poller.SetHookState(sessionID, state)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeHookSettings writes a Claude Code settings file that routes our hook
+// events for sessionID back to the agent. The file is passed to claude via
+// --settings so the user's own settings are left untouched.
+func writeHookSettings(sessionID, socketPath string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("get executable path: %w", err)
+	}
+
+	command := strings.Join([]string{
+		shellQuote(exe), "hook",
+		"--socket", shellQuote(socketPath),
+		"--session", shellQuote(sessionID),
+	}, " ")
+
+	type hookCommand struct {
+		Type    string `json:"type"`
+		Command string `json:"command"`
+		Timeout int    `json:"timeout"`
+	}
+	type hookMatcher struct {
+		Hooks []hookCommand `json:"hooks"`
+	}
+	hooks := make(map[string][]hookMatcher)
+	for event := range hookEventStates {
+		hooks[event] = []hookMatcher{{Hooks: []hookCommand{{Type: "command", Command: command, Timeout: 5}}}}
+	}
+
+	data, err := json.MarshalIndent(map[string]any{"hooks": hooks}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	dir := hookSettingsDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("creating hooks dir: %w", err)
+	}
+	path := filepath.Join(dir, sessionID+".json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return "", fmt.Errorf("writing hook settings: %w", err)
+	}
+	return path, nil
+}
+
+func removeHookSettings(sessionID string) {
+	os.Remove(filepath.Join(hookSettingsDir(), sessionID+".json"))
+}
+
+// runHookCommand implements `ccdash-agent hook`: it forwards the hook JSON on
+// stdin to the running agent. It never fails loudly — a broken dashboard
+// must not get in the way of Claude.
+func runHookCommand(args []string) int {
+	fs := flag.NewFlagSet("hook", flag.ContinueOnError)
+	socketPath := fs.String("socket", defaultHookSocket(), "Agent hook socket")
+	sessionID := fs.String("session", "", "tmux session ID")
+	if err := fs.Parse(args); err != nil || *sessionID == "" {
+		return 0
+	}
+
+	body, err := io.ReadAll(io.LimitReader(os.Stdin, 1<<20))
+	if err != nil {
+		return 0
+	}
+
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", *socketPath)
+			},
+		},
+	}
+	resp, err := client.Post("http://agent/hook?session="+url.QueryEscape(*sessionID), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+	return 0
+}
+
+// shellQuote quotes s for a POSIX shell, leaving plainly safe words as-is so
+// the command typed into the session stays readable.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, shellSafeChars) == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+const shellSafeChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_@%+=:,./-"
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// sharedTerminal is a single tmux client (one PTY) per tmux session whose
+// output is fanned out to every attached WebSocket connection. Only the
+// driver's input and resize requests reach the PTY; everyone else watches.
+type sharedTerminal struct {
+	sessionID string
+	term      *TerminalSession
+
+	mu       sync.Mutex
+	viewers  []*safeConn // in attach order
+	readOnly map[*safeConn]bool
+	driver   *safeConn
+}
+
+// addViewer registers conn and makes it the driver if nobody drives yet.
+func (st *sharedTerminal) addViewer(conn *safeConn, readOnly bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, v := range st.viewers {
+		if v == conn {
+			return
+		}
+	}
+	st.viewers = append(st.viewers, conn)
+	if readOnly {
+		if st.readOnly == nil {
+			st.readOnly = make(map[*safeConn]bool)
+		}
+		st.readOnly[conn] = true
+	} else if st.driver == nil {
+		st.driver = conn
+	}
+}
+
+// removeViewer unregisters conn, promotes the oldest remaining viewer that
+// didn't attach read-only if conn was the driver, and reports how many
+// viewers are left.
+func (st *sharedTerminal) removeViewer(conn *safeConn) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for i, v := range st.viewers {
+		if v == conn {
+			st.viewers = append(st.viewers[:i], st.viewers[i+1:]...)
+			break
+		}
+	}
+	delete(st.readOnly, conn)
+	if st.driver == conn {
+		st.driver = nil
+		for _, v := range st.viewers {
+			if !st.readOnly[v] {
+				st.driver = v
+				break
+			}
+		}
+	}
+	return len(st.viewers)
+}
+
+func (st *sharedTerminal) setDriver(conn *safeConn) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.readOnly, conn)
+	st.driver = conn
+}
+
+func (st *sharedTerminal) isDriver(conn *safeConn) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.driver == conn
+}
+
+func (st *sharedTerminal) snapshot() ([]*safeConn, *safeConn) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	viewers := make([]*safeConn, len(st.viewers))
+	copy(viewers, st.viewers)
+	return viewers, st.driver
+}
+
+// broadcast writes a pre-encoded message to every viewer.
+func (st *sharedTerminal) broadcast(data []byte) {
+	viewers, _ := st.snapshot()
+	for _, conn := range viewers {
+		if err := conn.safeWrite(websocket.TextMessage, data); err != nil {
+			conn.Close()
+		}
+	}
+}
+
+// notifyRoles tells every viewer whether it currently drives the terminal.
+func (st *sharedTerminal) notifyRoles() {
+	viewers, driver := st.snapshot()
+	for _, conn := range viewers {
+		role := "viewer"
+		if conn == driver {
+			role = "driver"
+		}
+		data, err := json.Marshal(ServerMessage{
+			Type:    "terminal_role",
+			Session: st.sessionID,
+			Role:    role,
+			Viewers: len(viewers),
+		})
+		if err != nil {
+			continue
+		}
+		conn.safeWrite(websocket.TextMessage, data)
+	}
+}
+
+// attachTerminal joins conn to the shared PTY for msg.SessionID, spawning the
+// tmux client on first attach. Later viewers trigger a client redraw so they
+// get a full screen instead of waiting for the next change. When
+// msg.HistoryLines is set, a scrollback snapshot is sent before any output.
+func (s *Server) attachTerminal(conn *safeConn, msg ClientMessage) (*sharedTerminal, error) {
+	sessionID := msg.SessionID
+	cols, rows := uint16(msg.Cols), uint16(msg.Rows)
+
+	if msg.HistoryLines > 0 {
+		s.sendScrollback(conn, sessionID, msg.HistoryLines, msg.Rows)
+	}
+
+	s.termMu.Lock()
+	st, exists := s.terminals[sessionID]
+	if !exists {
+		term := newTerminalSession()
+		if err := term.Attach(sessionID, cols, rows); err != nil {
+			s.termMu.Unlock()
+			return nil, err
+		}
+		st = &sharedTerminal{sessionID: sessionID, term: term}
+		s.terminals[sessionID] = st
+		go s.readPTY(st)
+	}
+	st.addViewer(conn, msg.ReadOnly)
+	s.termMu.Unlock()
+
+	if exists {
+		if err := st.term.Refresh(); err != nil {
+			log.Printf("attach %s: refresh: %v", sessionID, err)
+		}
+	}
+	st.notifyRoles()
+	return st, nil
+}
+
+// sendScrollback replays pane history above the visible screen as a
+// scrollback message. Blank lines are appended so the whole snapshot is
+// pushed into the client's scrollback before tmux repaints the screen.
+func (s *Server) sendScrollback(conn *safeConn, sessionID string, lines, rows int) {
+	if lines > s.config.HistoryLimit {
+		lines = s.config.HistoryLimit
+	}
+	if rows <= 0 {
+		rows = 50
+	}
+	history, err := capturePaneHistory(sessionID, lines, true)
+	if err != nil {
+		log.Printf("attach %s: scrollback: %v", sessionID, err)
+		return
+	}
+	if history == "" {
+		return
+	}
+	data := strings.ReplaceAll(history, "\n", "\r\n") + strings.Repeat("\r\n", rows)
+	s.sendMessage(conn, ServerMessage{
+		Type:    "scrollback",
+		Session: sessionID,
+		Data:    base64.StdEncoding.EncodeToString([]byte(data)),
+	})
+}
+
+// detachTerminal removes conn from st and tears down the tmux client once the
+// last viewer has gone.
+func (s *Server) detachTerminal(conn *safeConn, st *sharedTerminal) {
+	s.termMu.Lock()
+	remaining := st.removeViewer(conn)
+	if remaining == 0 {
+		if s.terminals[st.sessionID] == st {
+			delete(s.terminals, st.sessionID)
+		}
+		s.termMu.Unlock()
+		st.term.Detach()
+		return
+	}
+	s.termMu.Unlock()
+	st.notifyRoles()
+}
+
+// dropTerminal forgets st after its PTY has exited (e.g. session killed).
+func (s *Server) dropTerminal(st *sharedTerminal) {
+	s.termMu.Lock()
+	defer s.termMu.Unlock()
+	if s.terminals[st.sessionID] == st {
+		delete(s.terminals, st.sessionID)
+	}
+}
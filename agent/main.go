@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
@@ -9,14 +10,27 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
-	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var version = "dev"
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "hook":
+			os.Exit(runHookCommand(os.Args[2:]))
+		case "test-rules":
+			os.Exit(runTestRulesCommand(os.Args[2:]))
+		case "token":
+			os.Exit(runTokenCommand(os.Args[2:]))
+		case "record":
+			os.Exit(runRecordCommand(os.Args[2:]))
+		}
+	}
+
 	configPath := flag.String("config", "", "Path to config file")
 	bindFlag := flag.String("bind", "", "Override bind address (e.g. 0.0.0.0 for local testing)")
 	portFlag := flag.Int("port", 0, "Override port")
@@ -25,8 +39,7 @@ func main() {
 	// Determine config path
 	cfgPath := *configPath
 	if cfgPath == "" {
-		home, _ := os.UserHomeDir()
-		cfgPath = filepath.Join(home, ".claude-dashboard", "agent.yaml")
+		cfgPath = defaultConfigPath()
 	}
 
 	config, err := loadConfig(cfgPath)
@@ -34,6 +47,13 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	rules, err := loadStateRules(config)
+	if err != nil {
+		log.Fatalf("Failed to load state rules: %v", err)
+	}
+	setStateRules(rules)
+	go watchStateRules(cfgPath, config, 2*time.Second)
+
 	// Apply flag overrides
 	if *bindFlag != "" {
 		config.Bind = *bindFlag
@@ -62,12 +82,44 @@ func main() {
 
 	listenAddr := fmt.Sprintf("%s:%d", bindAddr, config.Port)
 
-	// Start poller
-	poller := newPoller()
-	poller.Start(500 * 1000000) // 500ms
+	// Session metadata survives restarts; reconciled against tmux on first poll
+	store, err := loadSessionStore(defaultSessionStorePath())
+	if err != nil {
+		log.Printf("WARNING: %v (starting with empty session store)", err)
+	}
+
+	// The server wires its callbacks into the poller and starts it
+	poller := newPoller(store)
+
+	// Receive Claude Code hook events for authoritative state detection
+	var hooks *hookReceiver
+	if config.Hooks {
+		hooks = newHookReceiver(config.HookSocket, poller)
+		if err := hooks.Start(); err != nil {
+			log.Printf("WARNING: hooks disabled: %v", err)
+			config.Hooks = false
+			hooks = nil
+		}
+	}
+
+	auth, err := newAuthenticator(config)
+	if err != nil {
+		log.Fatalf("Invalid tokens: %v", err)
+	}
+	go auth.watchTokens(2 * time.Second)
+
+	audit, err := openAuditLog(expandPath(config.AuditLog), int64(config.AuditMaxSizeMB)<<20, config.AuditKeep)
+	if err != nil {
+		log.Printf("WARNING: audit log disabled: %v", err)
+	}
 
 	// Create server
-	srv := newServer(config, poller)
+	srv := newServer(config, auth, audit, poller)
+
+	tlsConfig, err := buildTLSConfig(config, bindAddr)
+	if err != nil {
+		log.Fatalf("TLS: %v", err)
+	}
 
 	// Start HTTP server
 	listener, err := net.Listen("tcp", listenAddr)
@@ -75,9 +127,19 @@ func main() {
 		log.Fatalf("Failed to listen on %s: %v", listenAddr, err)
 	}
 
-	log.Printf("ccdash-agent %s listening on %s", version, listenAddr)
-	if config.Token != "" {
-		log.Printf("Auth token configured")
+	scheme := "ws"
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+		scheme = "wss"
+		log.Printf("TLS certificate SHA-256 fingerprint: %s", certFingerprint(tlsConfig.Certificates[0]))
+		if tlsConfig.ClientCAs != nil {
+			log.Printf("Client certificates required")
+		}
+	}
+
+	log.Printf("ccdash-agent %s listening on %s://%s/ws", version, scheme, listenAddr)
+	if n := auth.count(); n > 0 {
+		log.Printf("Auth: %d token(s) configured", n)
 	} else {
 		log.Printf("WARNING: No auth token configured")
 	}
@@ -89,7 +151,12 @@ func main() {
 		<-sigCh
 		log.Println("Shutting down...")
 		srv.usage.Stop()
+		srv.history.Close()
 		poller.Stop()
+		if hooks != nil {
+			hooks.Stop()
+		}
+		audit.Close()
 		listener.Close()
 		os.Exit(0)
 	}()
@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 // Metrics holds system-level telemetry collected periodically.
 type Metrics struct {
 	CpuPercent float64
@@ -9,4 +11,111 @@ type Metrics struct {
 	DiskUsed   uint64
 	UptimeSecs uint64
 	LoadAvg    float64
+
+	// Detail sent in the metrics message; parts a platform can't read are
+	// left empty.
+	At           time.Time
+	CPU          CPUMetrics
+	SwapTotal    uint64
+	SwapUsed     uint64
+	Load         [3]float64 // 1, 5 and 15 minutes
+	Filesystems  []FilesystemMetrics
+	Network      []NetworkMetrics
+	Temperatures []TemperatureMetrics
+}
+
+// CPUMetrics is CPU use since the previous sample, in percent of the time
+// available.
+type CPUMetrics struct {
+	Percent float64   `json:"percent"` // busy, all cores
+	User    float64   `json:"user"`    // including nice
+	System  float64   `json:"system"`  // including interrupts
+	Iowait  float64   `json:"iowait"`
+	Steal   float64   `json:"steal"`
+	Cores   []float64 `json:"cores"` // busy, per core
+}
+
+// FilesystemMetrics is the space on one mounted filesystem.
+type FilesystemMetrics struct {
+	Mount  string `json:"mount"`
+	Device string `json:"device,omitempty"`
+	Type   string `json:"type,omitempty"`
+	Total  uint64 `json:"total"`
+	Used   uint64 `json:"used"`
+}
+
+// NetworkMetrics is the traffic of one network interface.
+type NetworkMetrics struct {
+	Interface string  `json:"interface"`
+	RxBytes   uint64  `json:"rx_bytes"` // since boot
+	TxBytes   uint64  `json:"tx_bytes"`
+	RxRate    float64 `json:"rx_rate"` // bytes/s since the previous sample
+	TxRate    float64 `json:"tx_rate"`
+}
+
+// TemperatureMetrics is one thermal sensor's reading.
+type TemperatureMetrics struct {
+	Sensor  string  `json:"sensor"`
+	Celsius float64 `json:"celsius"`
+}
+
+// metricsVersion is the version of the metrics message. Fields may be added
+// within a version; renaming or removing one needs a new version.
+const metricsVersion = 1
+
+// MetricsMessage is the metrics WebSocket message: the host telemetry that
+// machine_info only summarizes.
+type MetricsMessage struct {
+	Type         string               `json:"type"`
+	Version      int                  `json:"version"`
+	Timestamp    int64                `json:"timestamp"` // unix millis
+	CPU          CPUMetrics           `json:"cpu"`
+	Memory       MemoryMetrics        `json:"memory"`
+	Load         [3]float64           `json:"load"` // 1, 5 and 15 minutes
+	UptimeSecs   uint64               `json:"uptime_secs"`
+	Filesystems  []FilesystemMetrics  `json:"filesystems"`
+	Network      []NetworkMetrics     `json:"network"`
+	Temperatures []TemperatureMetrics `json:"temperatures"`
+}
+
+// MemoryMetrics is RAM and swap, in bytes.
+type MemoryMetrics struct {
+	Total     uint64 `json:"total"`
+	Used      uint64 `json:"used"`
+	SwapTotal uint64 `json:"swap_total"`
+	SwapUsed  uint64 `json:"swap_used"`
+}
+
+// message wraps m in a metrics WebSocket message. Lists are never null.
+func (m Metrics) message() MetricsMessage {
+	msg := MetricsMessage{
+		Type:      "metrics",
+		Version:   metricsVersion,
+		Timestamp: m.At.UnixMilli(),
+		CPU:       m.CPU,
+		Memory: MemoryMetrics{
+			Total:     m.MemTotal,
+			Used:      m.MemUsed,
+			SwapTotal: m.SwapTotal,
+			SwapUsed:  m.SwapUsed,
+		},
+		Load:         m.Load,
+		UptimeSecs:   m.UptimeSecs,
+		Filesystems:  m.Filesystems,
+		Network:      m.Network,
+		Temperatures: m.Temperatures,
+	}
+	if msg.CPU.Cores == nil {
+		msg.CPU.Cores = []float64{}
+	}
+	if msg.Filesystems == nil {
+		msg.Filesystems = []FilesystemMetrics{}
+	}
+	if msg.Network == nil {
+		msg.Network = []NetworkMetrics{}
+	}
+	if msg.Temperatures == nil {
+		msg.Temperatures = []TemperatureMetrics{}
+	}
+	return msg
 }
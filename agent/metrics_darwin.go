@@ -108,16 +108,49 @@ func collectMemInfo() (total, used uint64) {
 	return
 }
 
-func collectDiskInfo() (total, used uint64) {
+func collectSwapInfo() (total, used uint64) {
+	var swap C.struct_xsw_usage
+	size := C.size_t(unsafe.Sizeof(swap))
+	name := C.CString("vm.swapusage")
+	defer C.free(unsafe.Pointer(name))
+	if C.sysctlbyname(name, unsafe.Pointer(&swap), &size, nil, 0) == 0 {
+		total, used = uint64(swap.xsu_total), uint64(swap.xsu_used)
+	}
+	return
+}
+
+// collectFilesystem stats the filesystem mounted at mount.
+func collectFilesystem(mount string) (FilesystemMetrics, bool) {
 	var stat C.struct_statfs
-	path := C.CString("/")
+	path := C.CString(mount)
 	defer C.free(unsafe.Pointer(path))
-	if C.statfs(path, &stat) == 0 {
-		total = uint64(stat.f_blocks) * uint64(stat.f_bsize)
-		avail := uint64(stat.f_bavail) * uint64(stat.f_bsize)
-		used = total - avail
+	if C.statfs(path, &stat) != 0 {
+		return FilesystemMetrics{}, false
 	}
-	return
+	total := uint64(stat.f_blocks) * uint64(stat.f_bsize)
+	avail := uint64(stat.f_bavail) * uint64(stat.f_bsize)
+	return FilesystemMetrics{
+		Mount:  mount,
+		Device: C.GoString(&stat.f_mntfromname[0]),
+		Type:   C.GoString(&stat.f_fstypename[0]),
+		Total:  total,
+		Used:   total - avail,
+	}, true
+}
+
+// collectFilesystems reports the given mount points, or just / with none
+// given.
+func collectFilesystems(points []string) []FilesystemMetrics {
+	if len(points) == 0 {
+		points = []string{"/"}
+	}
+	var result []FilesystemMetrics
+	for _, point := range points {
+		if fs, ok := collectFilesystem(point); ok && fs.Total > 0 {
+			result = append(result, fs)
+		}
+	}
+	return result
 }
 
 func collectUptime() uint64 {
@@ -132,25 +165,42 @@ func collectUptime() uint64 {
 	return 0
 }
 
-func collectLoadAvg() float64 {
+func collectLoadAvg() [3]float64 {
 	var load [3]C.double
-	if C.getloadavg(&load[0], 3) > 0 {
-		return float64(load[0])
+	var result [3]float64
+	if n := int(C.getloadavg(&load[0], 3)); n > 0 {
+		for i := 0; i < n; i++ {
+			result[i] = float64(load[i])
+		}
 	}
-	return 0
+	return result
 }
 
 // CollectMetrics gathers system CPU, memory, disk, uptime and load metrics.
-func CollectMetrics() Metrics {
+// filesystems lists the mount points to report; empty means just /. Per-core
+// CPU, network and temperatures aren't read here.
+func CollectMetrics(filesystems []string) Metrics {
 	memTotal, memUsed := collectMemInfo()
-	diskTotal, diskUsed := collectDiskInfo()
+	swapTotal, swapUsed := collectSwapInfo()
+	fss := collectFilesystems(filesystems)
+	var diskTotal, diskUsed uint64
+	if root, ok := collectFilesystem("/"); ok {
+		diskTotal, diskUsed = root.Total, root.Used
+	}
+	cpuPercent := collectCPUPercent()
+	load := collectLoadAvg()
 	return Metrics{
-		CpuPercent: collectCPUPercent(),
-		MemTotal:   memTotal,
-		MemUsed:    memUsed,
-		DiskTotal:  diskTotal,
-		DiskUsed:   diskUsed,
-		UptimeSecs: collectUptime(),
-		LoadAvg:    collectLoadAvg(),
+		CpuPercent:  cpuPercent,
+		MemTotal:    memTotal,
+		MemUsed:     memUsed,
+		DiskTotal:   diskTotal,
+		DiskUsed:    diskUsed,
+		UptimeSecs:  collectUptime(),
+		LoadAvg:     load[0],
+		CPU:         CPUMetrics{Percent: cpuPercent},
+		SwapTotal:   swapTotal,
+		SwapUsed:    swapUsed,
+		Load:        load,
+		Filesystems: fss,
 	}
 }
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Host metrics are kept at two resolutions: every sample (5s) for the last
+// hour, and one-minute averages for metrics_history (default 24h). The
+// minute averages can be saved to disk so charts survive agent restarts.
+const (
+	fineHistory     = time.Hour
+	metricsInterval = 5 * time.Second
+	coarseStep      = time.Minute
+
+	// maxHistoryPoints caps a metrics_history answer; longer ranges get a
+	// larger step.
+	maxHistoryPoints = 1000
+)
+
+func defaultMetricsHistoryPath() string {
+	return filepath.Join(agentDataDir(), "metrics_history.json")
+}
+
+// MetricsPoint is one point of the metrics history: the average of the
+// samples in its step.
+type MetricsPoint struct {
+	Timestamp int64   `json:"timestamp"` // unix millis, start of the step
+	CPU       float64 `json:"cpu"`       // percent busy, all cores
+	Iowait    float64 `json:"iowait"`
+	MemUsed   uint64  `json:"mem_used"`
+	MemTotal  uint64  `json:"mem_total"`
+	SwapUsed  uint64  `json:"swap_used"`
+	DiskUsed  uint64  `json:"disk_used"` // root filesystem
+	Load      float64 `json:"load"`      // 1-minute load average
+	RxRate    float64 `json:"rx_rate"`   // bytes/s, all interfaces
+	TxRate    float64 `json:"tx_rate"`
+}
+
+func metricsPoint(m Metrics) MetricsPoint {
+	p := MetricsPoint{
+		Timestamp: m.At.UnixMilli(),
+		CPU:       m.CPU.Percent,
+		Iowait:    m.CPU.Iowait,
+		MemUsed:   m.MemUsed,
+		MemTotal:  m.MemTotal,
+		SwapUsed:  m.SwapUsed,
+		DiskUsed:  m.DiskUsed,
+		Load:      m.Load[0],
+	}
+	for _, n := range m.Network {
+		p.RxRate += n.RxRate
+		p.TxRate += n.TxRate
+	}
+	return p
+}
+
+// pointSum averages points.
+type pointSum struct {
+	sum MetricsPoint
+	n   int
+}
+
+func (s *pointSum) add(p MetricsPoint) {
+	s.sum.CPU += p.CPU
+	s.sum.Iowait += p.Iowait
+	s.sum.MemUsed += p.MemUsed
+	s.sum.MemTotal += p.MemTotal
+	s.sum.SwapUsed += p.SwapUsed
+	s.sum.DiskUsed += p.DiskUsed
+	s.sum.Load += p.Load
+	s.sum.RxRate += p.RxRate
+	s.sum.TxRate += p.TxRate
+	s.n++
+}
+
+// average returns the mean of the points added, stamped at.
+func (s *pointSum) average(at int64) MetricsPoint {
+	n := uint64(s.n)
+	f := float64(s.n)
+	return MetricsPoint{
+		Timestamp: at,
+		CPU:       s.sum.CPU / f,
+		Iowait:    s.sum.Iowait / f,
+		MemUsed:   s.sum.MemUsed / n,
+		MemTotal:  s.sum.MemTotal / n,
+		SwapUsed:  s.sum.SwapUsed / n,
+		DiskUsed:  s.sum.DiskUsed / n,
+		Load:      s.sum.Load / f,
+		RxRate:    s.sum.RxRate / f,
+		TxRate:    s.sum.TxRate / f,
+	}
+}
+
+// pointRing keeps the newest len(points) points.
+type pointRing struct {
+	points []MetricsPoint
+	next   int
+	full   bool
+}
+
+func newPointRing(size int) *pointRing {
+	return &pointRing{points: make([]MetricsPoint, max(size, 1))}
+}
+
+func (r *pointRing) push(p MetricsPoint) {
+	r.points[r.next] = p
+	r.next = (r.next + 1) % len(r.points)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// all returns the points, oldest first.
+func (r *pointRing) all() []MetricsPoint {
+	if !r.full {
+		return append([]MetricsPoint(nil), r.points[:r.next]...)
+	}
+	return append(append([]MetricsPoint(nil), r.points[r.next:]...), r.points[:r.next]...)
+}
+
+// metricsHistory records host metrics samples for metrics_history.
+type metricsHistory struct {
+	retention time.Duration
+	path      string     // "" keeps the history in memory only
+	saveMu    sync.Mutex // orders writes of path; taken before mu
+
+	mu        sync.Mutex
+	fine      *pointRing
+	coarse    *pointRing
+	pending   pointSum // samples of the minute starting at pendingAt
+	pendingAt int64
+}
+
+// newMetricsHistory keeps minute averages for retention, loading those
+// saved at path if it is set.
+func newMetricsHistory(retention time.Duration, path string) *metricsHistory {
+	h := &metricsHistory{
+		retention: retention,
+		path:      path,
+		fine:      newPointRing(int(fineHistory / metricsInterval)),
+		coarse:    newPointRing(int(retention / coarseStep)),
+	}
+	if path != "" {
+		h.load()
+	}
+	return h
+}
+
+// Add records a sample, closing the previous minute's average once the
+// sample falls in a new minute.
+func (h *metricsHistory) Add(m Metrics) {
+	p := metricsPoint(m)
+	minute := p.Timestamp - p.Timestamp%coarseStep.Milliseconds()
+
+	h.saveMu.Lock()
+	defer h.saveMu.Unlock()
+	h.mu.Lock()
+	h.fine.push(p)
+	var closed []MetricsPoint
+	if h.pending.n > 0 && minute != h.pendingAt {
+		h.coarse.push(h.pending.average(h.pendingAt))
+		h.pending = pointSum{}
+		closed = h.coarse.all()
+	}
+	h.pendingAt = minute
+	h.pending.add(p)
+	h.mu.Unlock()
+
+	if closed != nil {
+		h.save(closed)
+	}
+}
+
+// Close saves the minute averages, including the minute under way, so a
+// restart loses no history.
+func (h *metricsHistory) Close() {
+	if h.path == "" {
+		return
+	}
+	h.saveMu.Lock()
+	defer h.saveMu.Unlock()
+	h.mu.Lock()
+	if h.pending.n > 0 {
+		h.coarse.push(h.pending.average(h.pendingAt))
+		h.pending = pointSum{}
+	}
+	points := h.coarse.all()
+	h.mu.Unlock()
+	h.save(points)
+}
+
+// HistoryQuery selects part of the metrics history.
+type HistoryQuery struct {
+	From, To time.Time
+	Step     time.Duration // 0 picks one giving at most maxHistoryPoints
+}
+
+// historyQuery parses the metrics_history fields of msg: since and until,
+// or a range ending now (default an hour), and a step.
+func (msg ClientMessage) historyQuery() (HistoryQuery, error) {
+	q := HistoryQuery{To: time.Now()}
+	var err error
+	if msg.Until != "" {
+		if q.To, err = time.Parse(time.RFC3339, msg.Until); err != nil {
+			return q, errors.New("until must be an RFC 3339 timestamp")
+		}
+	}
+	switch {
+	case msg.Since != "":
+		if q.From, err = time.Parse(time.RFC3339, msg.Since); err != nil {
+			return q, errors.New("since must be an RFC 3339 timestamp")
+		}
+	case msg.Range != "":
+		r, err := time.ParseDuration(msg.Range)
+		if err != nil || r <= 0 {
+			return q, errors.New("range must be a positive duration such as 6h")
+		}
+		q.From = q.To.Add(-r)
+	default:
+		q.From = q.To.Add(-time.Hour)
+	}
+	if msg.Step != "" {
+		if q.Step, err = time.ParseDuration(msg.Step); err != nil || q.Step <= 0 {
+			return q, errors.New("step must be a positive duration such as 1m")
+		}
+	}
+	if !q.From.Before(q.To) {
+		return q, errors.New("since must be before until")
+	}
+	return q, nil
+}
+
+// Query returns the history between q.From and q.To averaged over steps of
+// q.Step, oldest first, and the step used: at least a sample interval, no
+// finer than gives maxHistoryPoints, and whole minutes past a minute.
+// Before the last hour there is one point a minute, so finer steps leave
+// gaps there.
+func (h *metricsHistory) Query(q HistoryQuery) ([]MetricsPoint, time.Duration) {
+	step := max(q.Step, metricsInterval, q.To.Sub(q.From)/maxHistoryPoints)
+	if step > coarseStep {
+		step = (step + coarseStep - 1).Truncate(coarseStep)
+	} else {
+		step = (step + time.Second - 1).Truncate(time.Second)
+	}
+
+	h.mu.Lock()
+	fine := h.fine.all()
+	coarse := h.coarse.all()
+	h.mu.Unlock()
+
+	// Minute averages up to where the samples start, then the samples.
+	series := coarse
+	if len(fine) > 0 {
+		series = series[:0:0]
+		for _, p := range coarse {
+			if p.Timestamp+coarseStep.Milliseconds() <= fine[0].Timestamp {
+				series = append(series, p)
+			}
+		}
+		series = append(series, fine...)
+	}
+
+	from, to, width := q.From.UnixMilli(), q.To.UnixMilli(), step.Milliseconds()
+	points := []MetricsPoint{}
+	var bucket pointSum
+	var bucketAt int64
+	for _, p := range series {
+		if p.Timestamp < from || p.Timestamp > to {
+			continue
+		}
+		at := p.Timestamp - p.Timestamp%width
+		if bucket.n > 0 && at != bucketAt {
+			points = append(points, bucket.average(bucketAt))
+			bucket = pointSum{}
+		}
+		bucketAt = at
+		bucket.add(p)
+	}
+	if bucket.n > 0 {
+		points = append(points, bucket.average(bucketAt))
+	}
+	return points, step
+}
+
+// MetricsHistoryMessage answers metrics_history.
+type MetricsHistoryMessage struct {
+	Type     string         `json:"type"`
+	StepSecs int64          `json:"step_secs"`
+	Points   []MetricsPoint `json:"points"`
+}
+
+func (h *metricsHistory) message(q HistoryQuery) MetricsHistoryMessage {
+	points, step := h.Query(q)
+	return MetricsHistoryMessage{Type: "metrics_history", StepSecs: int64(step / time.Second), Points: points}
+}
+
+// savedHistory is the on-disk form of the minute averages.
+type savedHistory struct {
+	StepSecs int64          `json:"step_secs"`
+	Points   []MetricsPoint `json:"points"`
+}
+
+// load reads saved minute averages, dropping those past retention.
+func (h *metricsHistory) load() {
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("metrics history: %v", err)
+		}
+		return
+	}
+	var saved savedHistory
+	if err := json.Unmarshal(data, &saved); err != nil || saved.StepSecs != int64(coarseStep/time.Second) {
+		log.Printf("metrics history: ignoring %s", h.path)
+		return
+	}
+	oldest := time.Now().Add(-h.retention).UnixMilli()
+	for _, p := range saved.Points {
+		if p.Timestamp >= oldest {
+			h.coarse.push(p)
+		}
+	}
+}
+
+// save writes a copy of the minute averages atomically. Callers must hold
+// h.saveMu, not h.mu: queries shouldn't wait on the disk.
+func (h *metricsHistory) save(points []MetricsPoint) {
+	if h.path == "" {
+		return
+	}
+	data, err := json.Marshal(savedHistory{StepSecs: int64(coarseStep / time.Second), Points: points})
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0700); err != nil {
+		log.Printf("metrics history: %v", err)
+		return
+	}
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("metrics history: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		log.Printf("metrics history: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetricsHistoryQueryStep(t *testing.T) {
+	h := newMetricsHistory(24*time.Hour, "")
+	to := time.Now()
+	tests := []struct {
+		name   string
+		span   time.Duration
+		step   time.Duration
+		wantMs int64
+	}{
+		{"last hour picks the sample interval", time.Hour, 0, 5000},
+		{"six hours rounds up to a second", 6 * time.Hour, 0, 22000},
+		{"a day rounds up to whole minutes", 24 * time.Hour, 0, 120000},
+		{"a week", 7 * 24 * time.Hour, 0, 11 * 60000},
+		{"finer than a sample", time.Hour, time.Second, 5000},
+		{"fractional seconds", 10 * time.Minute, 7500 * time.Millisecond, 8000},
+		{"past a minute", time.Hour, 90 * time.Second, 120000},
+		{"too fine for the range", 24 * time.Hour, 10 * time.Second, 120000},
+		{"exactly a minute", time.Hour, time.Minute, 60000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, step := h.Query(HistoryQuery{From: to.Add(-tt.span), To: to, Step: tt.step})
+			if step.Milliseconds() != tt.wantMs {
+				t.Errorf("step = %s, want %s", step, time.Duration(tt.wantMs)*time.Millisecond)
+			}
+		})
+	}
+}
+
+// addMinutes adds a sample every metricsInterval for n minutes from start,
+// with CPU set to the minute's index.
+func addMinutes(h *metricsHistory, start time.Time, n int) {
+	for at := start; at.Before(start.Add(time.Duration(n) * time.Minute)); at = at.Add(metricsInterval) {
+		h.Add(Metrics{At: at, CPU: CPUMetrics{Percent: float64(at.Sub(start) / time.Minute)}})
+	}
+}
+
+func TestMetricsHistoryQueryAverages(t *testing.T) {
+	start := time.Now().Truncate(time.Hour).Add(-2 * time.Hour) // aligned to any step
+	h := newMetricsHistory(24*time.Hour, "")
+	// Two hours of samples: the first hour is left only as minute averages.
+	addMinutes(h, start, 120)
+
+	points, step := h.Query(HistoryQuery{From: start, To: start.Add(2 * time.Hour), Step: time.Minute})
+	if step != time.Minute {
+		t.Fatalf("step = %s", step)
+	}
+	if len(points) != 120 {
+		t.Fatalf("got %d points, want 120", len(points))
+	}
+	for i, p := range points {
+		if want := start.Add(time.Duration(i) * time.Minute).UnixMilli(); p.Timestamp != want || p.CPU != float64(i) {
+			t.Fatalf("point %d = %d cpu %v, want %d cpu %d", i, p.Timestamp, p.CPU, want, i)
+		}
+	}
+
+	// Wider steps average the minutes they cover. To is inclusive.
+	points, _ = h.Query(HistoryQuery{From: start, To: start.Add(10*time.Minute - time.Millisecond), Step: 5 * time.Minute})
+	if len(points) != 2 || points[0].CPU != 2 || points[1].CPU != 7 {
+		t.Errorf("5m points = %+v, want cpu 2 and 7", points)
+	}
+
+	// Outside the range there is nothing.
+	points, _ = h.Query(HistoryQuery{From: start.Add(-time.Hour), To: start.Add(-time.Minute)})
+	if len(points) != 0 {
+		t.Errorf("got %d points before the first sample", len(points))
+	}
+}
+
+func TestMetricsHistoryPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics_history.json")
+	start := time.Now().Truncate(time.Minute).Add(-10 * time.Minute)
+	h := newMetricsHistory(time.Hour, path)
+	addMinutes(h, start, 3)
+	h.Close() // saves the open third minute too
+
+	reloaded := newMetricsHistory(time.Hour, path)
+	points, _ := reloaded.Query(HistoryQuery{From: start, To: start.Add(time.Hour), Step: time.Minute})
+	if len(points) != 3 {
+		t.Fatalf("reloaded %d points, want 3", len(points))
+	}
+	for i, p := range points {
+		if p.CPU != float64(i) {
+			t.Errorf("point %d cpu = %v, want %d", i, p.CPU, i)
+		}
+	}
+
+	// Past retention, saved points are dropped on load.
+	if old := newMetricsHistory(5*time.Minute, path); len(old.coarse.all()) != 0 {
+		t.Errorf("loaded %d points older than retention", len(old.coarse.all()))
+	}
+}
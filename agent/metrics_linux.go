@@ -5,67 +5,103 @@ package main
 import (
 	"bufio"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
+// cpuTimes is one line of /proc/stat, in clock ticks.
+type cpuTimes struct {
+	user, nice, system, idle, iowait, irq, softirq, steal uint64
+}
+
+func (t cpuTimes) total() uint64 {
+	return t.user + t.nice + t.system + t.idle + t.iowait + t.irq + t.softirq + t.steal
+}
+
+// since returns t minus prev, field by field, treating counters that went
+// backwards (a CPU taken offline and back) as unchanged.
+func (t cpuTimes) since(prev cpuTimes) cpuTimes {
+	d := func(a, b uint64) uint64 {
+		if a < b {
+			return 0
+		}
+		return a - b
+	}
+	return cpuTimes{
+		user: d(t.user, prev.user), nice: d(t.nice, prev.nice), system: d(t.system, prev.system),
+		idle: d(t.idle, prev.idle), iowait: d(t.iowait, prev.iowait), irq: d(t.irq, prev.irq),
+		softirq: d(t.softirq, prev.softirq), steal: d(t.steal, prev.steal),
+	}
+}
+
 var (
-	prevCPUUser   uint64
-	prevCPUNice   uint64
-	prevCPUSystem uint64
-	prevCPUIdle   uint64
-	prevCPUIowait uint64
-	cpuMu         sync.Mutex
-	cpuInited     bool
+	prevCPU map[string]cpuTimes // "cpu" and "cpu0".."cpuN"
+	cpuMu   sync.Mutex
 )
 
-func collectCPUPercent() float64 {
+// collectCPU returns CPU use since the previous call, overall and per core.
+// The first call has nothing to compare with and reports zero.
+func collectCPU() CPUMetrics {
 	cpuMu.Lock()
 	defer cpuMu.Unlock()
 
 	f, err := os.Open("/proc/stat")
 	if err != nil {
-		return 0
+		return CPUMetrics{}
 	}
 	defer f.Close()
 
+	// Lines: "cpu  user nice system idle iowait irq softirq steal ...", then
+	// one per core.
+	cur := make(map[string]cpuTimes)
+	var cores []string
 	scanner := bufio.NewScanner(f)
-	if !scanner.Scan() {
-		return 0
-	}
-	// First line: "cpu  user nice system idle iowait irq softirq steal ..."
-	fields := strings.Fields(scanner.Text())
-	if len(fields) < 5 || fields[0] != "cpu" {
-		return 0
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		var v [8]uint64
+		for i := 0; i < len(v) && i+1 < len(fields); i++ {
+			v[i], _ = strconv.ParseUint(fields[i+1], 10, 64)
+		}
+		cur[fields[0]] = cpuTimes{v[0], v[1], v[2], v[3], v[4], v[5], v[6], v[7]}
+		if fields[0] != "cpu" {
+			cores = append(cores, fields[0])
+		}
 	}
 
-	user, _ := strconv.ParseUint(fields[1], 10, 64)
-	nice, _ := strconv.ParseUint(fields[2], 10, 64)
-	system, _ := strconv.ParseUint(fields[3], 10, 64)
-	idle, _ := strconv.ParseUint(fields[4], 10, 64)
-	var iowait uint64
-	if len(fields) > 5 {
-		iowait, _ = strconv.ParseUint(fields[5], 10, 64)
+	percent := func(part, total uint64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(part) / float64(total) * 100
 	}
-
-	if !cpuInited {
-		prevCPUUser, prevCPUNice, prevCPUSystem, prevCPUIdle, prevCPUIowait = user, nice, system, idle, iowait
-		cpuInited = true
-		return 0
+	busy := func(d cpuTimes) float64 {
+		return percent(d.total()-d.idle-d.iowait, d.total())
 	}
 
-	du := (user + nice) - (prevCPUUser + prevCPUNice)
-	ds := system - prevCPUSystem
-	di := (idle + iowait) - (prevCPUIdle + prevCPUIowait)
-	prevCPUUser, prevCPUNice, prevCPUSystem, prevCPUIdle, prevCPUIowait = user, nice, system, idle, iowait
-
-	total := du + ds + di
-	if total == 0 {
-		return 0
+	var m CPUMetrics
+	if prev, ok := prevCPU["cpu"]; ok {
+		d := cur["cpu"].since(prev)
+		m.Percent = busy(d)
+		m.User = percent(d.user+d.nice, d.total())
+		m.System = percent(d.system+d.irq+d.softirq, d.total())
+		m.Iowait = percent(d.iowait, d.total())
+		m.Steal = percent(d.steal, d.total())
 	}
-	return float64(du+ds) / float64(total) * 100
+	m.Cores = make([]float64, len(cores))
+	for i, name := range cores {
+		if prev, ok := prevCPU[name]; ok {
+			m.Cores[i] = busy(cur[name].since(prev))
+		}
+	}
+	prevCPU = cur
+	return m
 }
 
 func collectMemInfo() (total, used uint64) {
@@ -81,9 +117,20 @@ func collectMemInfo() (total, used uint64) {
 	return
 }
 
-func collectDiskInfo() (total, used uint64) {
+func collectSwapInfo() (total, used uint64) {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return 0, 0
+	}
+	unit := uint64(info.Unit)
+	total = info.Totalswap * unit
+	used = total - info.Freeswap*unit
+	return
+}
+
+func collectDiskInfo(path string) (total, used uint64) {
 	var stat syscall.Statfs_t
-	if err := syscall.Statfs("/", &stat); err != nil {
+	if err := syscall.Statfs(path, &stat); err != nil {
 		return 0, 0
 	}
 	total = stat.Blocks * uint64(stat.Bsize)
@@ -92,6 +139,174 @@ func collectDiskInfo() (total, used uint64) {
 	return
 }
 
+// virtualFilesystems are mount types that hold no files on a disk.
+var virtualFilesystems = map[string]bool{
+	"autofs": true, "binfmt_misc": true, "bpf": true, "cgroup": true, "cgroup2": true,
+	"configfs": true, "debugfs": true, "devpts": true, "devtmpfs": true, "efivarfs": true,
+	"fusectl": true, "hugetlbfs": true, "mqueue": true, "nsfs": true, "overlay": true,
+	"proc": true, "pstore": true, "ramfs": true, "rpc_pipefs": true, "securityfs": true,
+	"selinuxfs": true, "squashfs": true, "sysfs": true, "tmpfs": true, "tracefs": true,
+	"fuse.lxcfs": true, "fuse.gvfsd-fuse": true, "fuse.portal": true,
+}
+
+type mount struct {
+	device, point, fsType string
+}
+
+// readMounts parses /proc/self/mounts, whose fields escape spaces and other
+// awkward characters as octal (\040).
+func readMounts() []mount {
+	data, err := os.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return nil
+	}
+	unescape := func(s string) string {
+		if !strings.Contains(s, `\`) {
+			return s
+		}
+		var b strings.Builder
+		for i := 0; i < len(s); i++ {
+			if s[i] == '\\' && i+3 < len(s) {
+				if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+					b.WriteByte(byte(n))
+					i += 3
+					continue
+				}
+			}
+			b.WriteByte(s[i])
+		}
+		return b.String()
+	}
+	var mounts []mount
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		mounts = append(mounts, mount{unescape(fields[0]), unescape(fields[1]), fields[2]})
+	}
+	return mounts
+}
+
+// collectFilesystems reports the given mount points or, with none given,
+// / and every mounted filesystem that isn't virtual, each device once.
+func collectFilesystems(points []string) []FilesystemMetrics {
+	mounts := readMounts()
+	if len(points) == 0 {
+		points = []string{"/"}
+		seen := map[string]bool{"/": true} // devices and mount points
+		for _, m := range mounts {
+			if m.point == "/" {
+				seen[m.device] = true
+			}
+		}
+		for _, m := range mounts {
+			if virtualFilesystems[m.fsType] || seen[m.device] || seen[m.point] {
+				continue
+			}
+			seen[m.device], seen[m.point] = true, true
+			points = append(points, m.point)
+		}
+	}
+
+	var result []FilesystemMetrics
+	for _, point := range points {
+		total, used := collectDiskInfo(point)
+		if total == 0 {
+			continue
+		}
+		fs := FilesystemMetrics{Mount: point, Total: total, Used: used}
+		// The last mount on a point is the visible one.
+		for _, m := range mounts {
+			if m.point == point {
+				fs.Device, fs.Type = m.device, m.fsType
+			}
+		}
+		result = append(result, fs)
+	}
+	return result
+}
+
+type netCounters struct {
+	rx, tx uint64
+}
+
+var (
+	prevNet   map[string]netCounters
+	prevNetAt time.Time
+	netMu     sync.Mutex
+)
+
+// collectNetwork reports traffic per interface, leaving out loopback and
+// the veth ends of containers (their traffic also crosses a bridge). Rates
+// are zero on the first call.
+func collectNetwork() []NetworkMetrics {
+	netMu.Lock()
+	defer netMu.Unlock()
+
+	data, err := os.ReadFile("/proc/net/dev")
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	elapsed := now.Sub(prevNetAt).Seconds()
+	cur := make(map[string]netCounters)
+	var result []NetworkMetrics
+	// Two header lines, then "  eth0: rx_bytes rx_packets ... tx_bytes ...".
+	for _, line := range strings.Split(string(data), "\n") {
+		name, rest, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "lo" || strings.HasPrefix(name, "veth") {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) < 9 {
+			continue
+		}
+		rx, _ := strconv.ParseUint(fields[0], 10, 64)
+		tx, _ := strconv.ParseUint(fields[8], 10, 64)
+		cur[name] = netCounters{rx, tx}
+		n := NetworkMetrics{Interface: name, RxBytes: rx, TxBytes: tx}
+		if prev, ok := prevNet[name]; ok && elapsed > 0 && rx >= prev.rx && tx >= prev.tx {
+			n.RxRate = float64(rx-prev.rx) / elapsed
+			n.TxRate = float64(tx-prev.tx) / elapsed
+		}
+		result = append(result, n)
+	}
+	prevNet, prevNetAt = cur, now
+	return result
+}
+
+// collectTemperatures reads the kernel's thermal zones, named by type.
+// Repeated types are numbered: acpitz, acpitz-1, ...
+func collectTemperatures() []TemperatureMetrics {
+	zones, _ := filepath.Glob("/sys/class/thermal/thermal_zone*")
+	var result []TemperatureMetrics
+	seen := make(map[string]int)
+	for _, zone := range zones {
+		data, err := os.ReadFile(filepath.Join(zone, "temp"))
+		if err != nil {
+			continue // some zones can't be read while their device sleeps
+		}
+		milli, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			continue
+		}
+		sensor := filepath.Base(zone)
+		if kind, err := os.ReadFile(filepath.Join(zone, "type")); err == nil {
+			sensor = strings.TrimSpace(string(kind))
+		}
+		if n := seen[sensor]; n > 0 {
+			seen[sensor]++
+			sensor += "-" + strconv.Itoa(n)
+		} else {
+			seen[sensor] = 1
+		}
+		result = append(result, TemperatureMetrics{Sensor: sensor, Celsius: float64(milli) / 1000})
+	}
+	return result
+}
+
 func collectUptime() uint64 {
 	var info syscall.Sysinfo_t
 	if err := syscall.Sysinfo(&info); err != nil {
@@ -100,30 +315,42 @@ func collectUptime() uint64 {
 	return uint64(info.Uptime)
 }
 
-func collectLoadAvg() float64 {
+func collectLoadAvg() [3]float64 {
+	var load [3]float64
 	data, err := os.ReadFile("/proc/loadavg")
 	if err != nil {
-		return 0
+		return load
 	}
 	fields := strings.Fields(string(data))
-	if len(fields) < 1 {
-		return 0
+	for i := 0; i < len(load) && i < len(fields); i++ {
+		load[i], _ = strconv.ParseFloat(fields[i], 64)
 	}
-	load, _ := strconv.ParseFloat(fields[0], 64)
 	return load
 }
 
-// CollectMetrics gathers system CPU, memory, disk, uptime and load metrics.
-func CollectMetrics() Metrics {
+// CollectMetrics gathers system CPU, memory, disk, network, temperature,
+// uptime and load metrics. filesystems lists the mount points to report;
+// empty means every non-virtual filesystem.
+func CollectMetrics(filesystems []string) Metrics {
 	memTotal, memUsed := collectMemInfo()
-	diskTotal, diskUsed := collectDiskInfo()
+	swapTotal, swapUsed := collectSwapInfo()
+	diskTotal, diskUsed := collectDiskInfo("/")
+	cpu := collectCPU()
+	load := collectLoadAvg()
 	return Metrics{
-		CpuPercent: collectCPUPercent(),
-		MemTotal:   memTotal,
-		MemUsed:    memUsed,
-		DiskTotal:  diskTotal,
-		DiskUsed:   diskUsed,
-		UptimeSecs: collectUptime(),
-		LoadAvg:    collectLoadAvg(),
+		CpuPercent:   cpu.Percent,
+		MemTotal:     memTotal,
+		MemUsed:      memUsed,
+		DiskTotal:    diskTotal,
+		DiskUsed:     diskUsed,
+		UptimeSecs:   collectUptime(),
+		LoadAvg:      load[0],
+		CPU:          cpu,
+		SwapTotal:    swapTotal,
+		SwapUsed:     swapUsed,
+		Load:         load,
+		Filesystems:  collectFilesystems(filesystems),
+		Network:      collectNetwork(),
+		Temperatures: collectTemperatures(),
 	}
 }
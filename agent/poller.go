@@ -2,6 +2,8 @@ package main
 
 import (
 	"log"
+	"maps"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -17,31 +19,203 @@ type SessionInfo struct {
 	Created        int64        `json:"created"`
 	StateChangedAt int64        `json:"state_changed_at"`
 	LastLine       string       `json:"last_line"`
+	Profile        string       `json:"profile"`
+	StateSource    string       `json:"state_source"` // "hook", "screen" or "budget"
+	Tags           []string     `json:"tags,omitempty"`
+	Note           string       `json:"note,omitempty"`
+
+	// Prompt is the parsed choice dialog while the session needs attention.
+	Prompt *PermissionPrompt `json:"prompt,omitempty"`
+
+	// Spend in USD: this session's conversations, and its workdir over
+	// cost_window. BudgetExceeded names the budget it crossed, if any.
+	Cost           float64 `json:"cost"`
+	WorkdirCost    float64 `json:"workdir_cost"`
+	BudgetExceeded string  `json:"budget_exceeded,omitempty"`
+
+	// ClaudeSessionIDs are the Claude conversations run in this session:
+	// the one it resumed and those its hooks reported, then any attributed
+	// by workdir and start time. Usage totals them.
+	ClaudeSessionIDs []string     `json:"claude_session_ids,omitempty"`
+	Usage            SessionUsage `json:"usage"`
+
+	// Resources is what the session's processes use, sampled every
+	// procSampleInterval. Zero where the OS has no /proc.
+	Resources SessionResources `json:"resources"`
+
+	hooked []string // conversations resumed or reported by hooks
 }
 
+// SessionUsage totals the usage entries of a session's conversations.
+type SessionUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	Messages                 int `json:"messages"`
+}
+
+func (u *SessionUsage) add(o SessionUsage) {
+	u.InputTokens += o.InputTokens
+	u.OutputTokens += o.OutputTokens
+	u.CacheCreationInputTokens += o.CacheCreationInputTokens
+	u.CacheReadInputTokens += o.CacheReadInputTokens
+	u.Messages += o.Messages
+}
+
+// applyMeta copies the persisted, user-editable fields onto info.
+func (info *SessionInfo) applyMeta(meta SessionMeta) {
+	info.Name = meta.Name
+	info.Workdir = meta.Workdir
+	info.Profile = meta.Profile
+	info.Tags = meta.Tags
+	info.Note = meta.Note
+	info.hooked = meta.ClaudeSessionIDs
+}
+
+// Where a session's state came from.
+const (
+	stateSourceHook   = "hook"
+	stateSourceScreen = "screen"
+	stateSourceBudget = "budget"
+)
+
+// hookState is the last state reported by a Claude Code hook for a session.
+type hookState struct {
+	state SessionState
+	at    time.Time
+}
+
+// budgetFlag records a budget a session crossed. Until someone acts on the
+// session, it is held at needs_attention.
+type budgetFlag struct {
+	budget string
+	acked  bool
+}
+
+// hookGrace is how long a hook-reported state is trusted when the screen
+// says otherwise. Interrupting Claude with Esc fires no hook, and a hook
+// can time out or fail to reach the agent, so after this the screen wins.
+const hookGrace = 10 * time.Second
+
 type Poller struct {
 	mu       sync.RWMutex
 	sessions map[string]*SessionInfo // sessionName -> info
-	workdirs map[string]string       // sessionName -> workdir (tracked at creation)
+	store    *sessionStore           // persisted metadata (name, workdir, profile, ...)
+	hooks    map[string]hookState    // sessionName -> last hook-reported state
+	budgets  map[string]budgetFlag   // sessionName -> crossed budget
+	procs    *processSampler
+	changes  map[stateTransition]int // state changes seen, for /metrics
 	onChange func(sessions []*SessionInfo)
 	stopCh   chan struct{}
+
+	// detectorFor resolves a launch profile to its state rule set name.
+	detectorFor func(profile string) string
+
+	// annotate adds derived fields (costs) to the sessions after each poll.
+	// It is called with p.mu held.
+	annotate func(sessions map[string]*SessionInfo)
 }
 
-func newPoller() *Poller {
+func newPoller(store *sessionStore) *Poller {
 	return &Poller{
 		sessions: make(map[string]*SessionInfo),
-		workdirs: make(map[string]string),
+		store:    store,
+		hooks:    make(map[string]hookState),
+		budgets:  make(map[string]budgetFlag),
+		procs:    newProcessSampler(),
+		changes:  make(map[stateTransition]int),
 		stopCh:   make(chan struct{}),
+		detectorFor: func(string) string {
+			return defaultDetector
+		},
 	}
 }
 
-func (p *Poller) TrackSession(name, workdir string) {
+// TrackSession records metadata for a session the agent just created.
+func (p *Poller) TrackSession(name string, meta SessionMeta) {
+	p.store.Put(name, meta)
+}
+
+// UpdateMeta applies fn to a session's persisted metadata and mirrors the
+// result into the live session list. It reports false for unknown sessions.
+func (p *Poller) UpdateMeta(name string, fn func(*SessionMeta)) bool {
+	if !p.store.Update(name, fn) {
+		return false
+	}
+	meta, _ := p.store.Get(name)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if info, ok := p.sessions[name]; ok {
+		info.applyMeta(meta)
+	}
+	return true
+}
+
+// SessionProfile returns the launch profile a session was created with.
+func (p *Poller) SessionProfile(name string) string {
+	meta, _ := p.store.Get(name)
+	return meta.Profile
+}
+
+// SetHookState records an authoritative state reported by a Claude Code hook.
+// It takes precedence over screen scraping from the next poll on.
+func (p *Poller) SetHookState(name string, state SessionState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hooks[name] = hookState{state: state, at: time.Now()}
+}
+
+// LinkConversation records that a Claude conversation runs in a session, as
+// reported by its hooks.
+func (p *Poller) LinkConversation(name, conversation string) {
+	if meta, ok := p.store.Get(name); !ok || slices.Contains(meta.ClaudeSessionIDs, conversation) {
+		return
+	}
+	p.UpdateMeta(name, func(m *SessionMeta) {
+		if !slices.Contains(m.ClaudeSessionIDs, conversation) {
+			m.ClaudeSessionIDs = append(m.ClaudeSessionIDs, conversation)
+		}
+	})
+}
+
+// FlagBudget marks a session as over budget, holding it at needs_attention
+// until AckBudget.
+func (p *Poller) FlagBudget(name, budget string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.budgets[name] = budgetFlag{budget: budget}
+}
+
+// AckBudget releases a budget flag once someone has acted on the session.
+// The session keeps reporting which budget it exceeded.
+func (p *Poller) AckBudget(name string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.workdirs[name] = workdir
+	if f, ok := p.budgets[name]; ok && !f.acked {
+		f.acked = true
+		p.budgets[name] = f
+	}
+}
+
+// stateTransition is a change of a session's state.
+type stateTransition struct {
+	from, to SessionState
+}
+
+// StateTransitions returns how often sessions changed from one state to
+// another since the agent started.
+func (p *Poller) StateTransitions() map[stateTransition]int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return maps.Clone(p.changes)
 }
 
+// Start polls once right away, so sessions are known by the time Start
+// returns, then every interval.
 func (p *Poller) Start(interval time.Duration) {
+	p.poll()
 	go func() {
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
@@ -64,7 +238,9 @@ func (p *Poller) RemoveSession(name string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	delete(p.sessions, name)
-	delete(p.workdirs, name)
+	delete(p.hooks, name)
+	delete(p.budgets, name)
+	p.store.Delete(name)
 }
 
 func (p *Poller) GetSessions() []*SessionInfo {
@@ -81,12 +257,30 @@ func (p *Poller) GetSessions() []*SessionInfo {
 	return result
 }
 
+// GetSession returns a copy of one session's info.
+func (p *Poller) GetSession(name string) (*SessionInfo, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	s, ok := p.sessions[name]
+	if !ok {
+		return nil, false
+	}
+	cp := *s
+	return &cp, true
+}
+
 func (p *Poller) poll() {
+	listedAt := time.Now().UnixMilli()
 	tmuxSessions, err := listTmuxSessions()
 	if err != nil {
 		log.Printf("poll: list sessions error: %v", err)
 		return
 	}
+	panes := make(map[string]int, len(tmuxSessions))
+	for _, ts := range tmuxSessions {
+		panes[ts.Name] = ts.PanePID
+	}
+	resources := p.procs.sample(panes)
 
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -99,27 +293,61 @@ func (p *Poller) poll() {
 		currentNames[ts.Name] = true
 	}
 
-	// Remove sessions that no longer exist in tmux
+	// Remove sessions that no longer exist in tmux, including ones that died
+	// while the agent was down.
 	for name := range p.sessions {
 		if !currentNames[name] {
 			delete(p.sessions, name)
-			delete(p.workdirs, name)
+			delete(p.hooks, name)
+			delete(p.budgets, name)
 		}
 	}
+	for _, name := range p.store.Reconcile(currentNames, listedAt) {
+		removeHookSettings(name)
+	}
 
 	// Update or add sessions
 	for _, ts := range tmuxSessions {
 		existing, exists := p.sessions[ts.Name]
 
+		meta, known := p.store.Get(ts.Name)
+		if !known {
+			// Session predates the store or was started outside the agent.
+			meta = SessionMeta{
+				Name:      displayNameFromID(ts.Name),
+				CreatedAt: ts.Created * 1000,
+			}
+			if wd, err := getPaneWorkdir(ts.Name); err == nil {
+				meta.Workdir = wd
+			}
+			p.store.Put(ts.Name, meta)
+		}
+
 		var state SessionState
 		var lastLine string
+		var prompt *PermissionPrompt
+		source := stateSourceScreen
 
 		// Capture visible pane for state detection
 		paneText, err := capturePaneVisible(ts.Name)
 		if err != nil {
 			state = StateDead
 		} else {
-			state = detectState(paneText)
+			state = detectState(p.detectorFor(meta.Profile), paneText)
+			if hs, ok := p.hooks[ts.Name]; ok {
+				stale := hs.state != state && time.Since(hs.at) > hookGrace
+				if !stale {
+					state = hs.state
+					source = stateSourceHook
+				}
+			}
+			if f, ok := p.budgets[ts.Name]; ok && !f.acked {
+				state = StateNeedsAttention
+				source = stateSourceBudget
+			}
+			if state == StateNeedsAttention {
+				prompt = parsePermissionPrompt(paneText)
+			}
 			lastLine = extractContentLine(paneText)
 			// Fallback: if smart extraction filtered everything out,
 			// show the raw last non-empty line — junk is better than nothing.
@@ -132,31 +360,37 @@ func (p *Poller) poll() {
 
 		if exists {
 			if existing.State != state {
+				p.changes[stateTransition{existing.State, state}]++
 				existing.State = state
 				existing.StateChangedAt = now
 			}
+			existing.StateSource = source
 			existing.LastLine = lastLine
+			existing.Prompt = prompt
+			existing.BudgetExceeded = p.budgets[ts.Name].budget
+			existing.Resources = resources[ts.Name]
+			existing.applyMeta(meta)
 		} else {
-			workdir := p.workdirs[ts.Name]
-			if workdir == "" {
-				// Recover workdir from tmux for pre-existing sessions
-				if wd, err := getPaneWorkdir(ts.Name); err == nil && wd != "" {
-					workdir = wd
-					p.workdirs[ts.Name] = workdir
-				}
-			}
-			p.sessions[ts.Name] = &SessionInfo{
+			info := &SessionInfo{
 				ID:             ts.Name,
-				Name:           ts.Name,
 				State:          state,
-				Workdir:        workdir,
 				Created:        ts.Created,
 				StateChangedAt: now,
-				LastLine:        lastLine,
+				LastLine:       lastLine,
+				StateSource:    source,
+				Prompt:         prompt,
+				BudgetExceeded: p.budgets[ts.Name].budget,
+				Resources:      resources[ts.Name],
 			}
+			info.applyMeta(meta)
+			p.sessions[ts.Name] = info
 		}
 	}
 
+	if p.annotate != nil {
+		p.annotate(p.sessions)
+	}
+
 	// Notify
 	if p.onChange != nil {
 		sessions := make([]*SessionInfo, 0, len(p.sessions))
@@ -171,11 +405,21 @@ func (p *Poller) poll() {
 	}
 }
 
+// displayNameFromID recovers the user-facing name from a cc-<millis>-<name>
+// tmux session ID.
+func displayNameFromID(id string) string {
+	parts := strings.SplitN(id, "-", 3)
+	if len(parts) == 3 && parts[0] == "cc" && parts[2] != "" {
+		return parts[2]
+	}
+	return id
+}
+
 // Chrome lines to skip when extracting content from Claude Code terminal.
 var (
 	// skipContaining — skip lines that contain any of these substrings.
 	skipContaining = []string{
-		"⏵",        // permission mode indicator
+		"⏵",         // permission mode indicator
 		"shift+tab", // mode cycling hint
 		"esc to interrupt",
 	}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"time"
+)
+
+// SessionResources is what a session's processes use: its pane's process
+// and everything below it.
+type SessionResources struct {
+	CPUPercent float64 `json:"cpu_percent"` // of one core, since the last sample
+	RSS        uint64  `json:"rss"`         // bytes
+	Processes  int     `json:"processes"`
+	TopCommand string  `json:"top_command,omitempty"` // name of the busiest process below the pane's
+}
+
+// procSampleInterval is how often the poller samples session processes; it
+// polls far more often than CPU figures are worth recomputing.
+const procSampleInterval = 5 * time.Second
+
+// procStat is one process as read from the OS.
+type procStat struct {
+	ppid  int
+	start uint64 // start time, to tell a reused PID from the process before
+	cpu   time.Duration
+	rss   uint64
+}
+
+type procCPU struct {
+	start uint64
+	cpu   time.Duration
+}
+
+// processSampler turns process snapshots into per-session resource usage.
+// It is only used from the poll goroutine.
+type processSampler struct {
+	prev   map[int]procCPU
+	prevAt time.Time
+	last   map[string]SessionResources // tmux session -> last sample
+}
+
+func newProcessSampler() *processSampler {
+	return &processSampler{last: make(map[string]SessionResources)}
+}
+
+// sample returns the resources of each session, keyed by tmux session
+// name, given its pane PID. Between samples it returns the previous ones.
+func (ps *processSampler) sample(panes map[string]int) map[string]SessionResources {
+	now := time.Now()
+	if now.Sub(ps.prevAt) < procSampleInterval {
+		return ps.last
+	}
+	procs, err := readProcesses()
+	if err != nil {
+		return ps.last
+	}
+
+	children := make(map[int][]int)
+	for pid, p := range procs {
+		children[p.ppid] = append(children[p.ppid], pid)
+	}
+	// CPU time used since the previous sample; a process started since then
+	// used all of its time within the interval.
+	used := func(pid int) time.Duration {
+		p := procs[pid]
+		if prev, ok := ps.prev[pid]; ok && prev.start == p.start && p.cpu >= prev.cpu {
+			return p.cpu - prev.cpu
+		}
+		return p.cpu
+	}
+	elapsed := now.Sub(ps.prevAt)
+
+	result := make(map[string]SessionResources, len(panes))
+	for name, panePID := range panes {
+		if _, ok := procs[panePID]; !ok {
+			continue
+		}
+		var r SessionResources
+		var cpu time.Duration
+		top, topCPU, topRSS := 0, time.Duration(-1), uint64(0)
+		queue := []int{panePID}
+		for len(queue) > 0 {
+			pid := queue[0]
+			queue = queue[1:]
+			queue = append(queue, children[pid]...)
+			c := used(pid)
+			r.Processes++
+			r.RSS += procs[pid].rss
+			cpu += c
+			if pid != panePID && (c > topCPU || c == topCPU && procs[pid].rss > topRSS) {
+				top, topCPU, topRSS = pid, c, procs[pid].rss
+			}
+		}
+		if !ps.prevAt.IsZero() {
+			r.CPUPercent = float64(cpu) / float64(elapsed) * 100
+		}
+		if top != 0 {
+			r.TopCommand = processName(top)
+		}
+		result[name] = r
+	}
+
+	ps.prev = make(map[int]procCPU, len(procs))
+	for pid, p := range procs {
+		ps.prev[pid] = procCPU{start: p.start, cpu: p.cpu}
+	}
+	ps.prevAt = now
+	ps.last = result
+	return result
+}
@@ -0,0 +1,76 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc. It has been 100 on
+// every Linux architecture for decades.
+const clockTicks = 100
+
+// readProcesses reads every process from /proc.
+func readProcesses() (map[int]procStat, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	pageSize := uint64(os.Getpagesize())
+	procs := make(map[int]procStat, len(entries))
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile("/proc/" + e.Name() + "/stat")
+		if err != nil {
+			continue // exited
+		}
+		p, err := parseProcStat(data)
+		if err != nil {
+			continue
+		}
+		p.rss *= pageSize
+		procs[pid] = p
+	}
+	return procs, nil
+}
+
+// parseProcStat parses /proc/<pid>/stat. The command name is in parentheses
+// and may itself contain spaces and parentheses, so fields are counted from
+// the last ")". RSS is left in pages.
+func parseProcStat(data []byte) (procStat, error) {
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return procStat{}, errors.New("malformed stat")
+	}
+	// Fields from 3 (state) on; utime is 14, stime 15, starttime 22, rss 24.
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 22 {
+		return procStat{}, errors.New("malformed stat")
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	start, _ := strconv.ParseUint(fields[19], 10, 64)
+	rss, _ := strconv.ParseInt(fields[21], 10, 64)
+	return procStat{
+		ppid:  ppid,
+		start: start,
+		cpu:   time.Duration(utime+stime) * time.Second / clockTicks,
+		rss:   uint64(max(rss, 0)),
+	}, nil
+}
+
+// processName returns a process's name (at most 15 bytes), never its
+// arguments: every viewer sees it, and command lines carry tokens.
+func processName(pid int) string {
+	data, _ := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/comm")
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseProcStat(t *testing.T) {
+	const tail = " S 42 1234 1234 34816 1234 4194304 1000 0 0 0 250 50 0 0 20 0 1 0 98765 12345678 512 18446744073709551615 1 1 0 0 0 0 0 0 0 0 0 0 17 3 0 0 0 0 0"
+	want := procStat{ppid: 42, start: 98765, cpu: 3 * time.Second, rss: 512}
+
+	tests := []struct {
+		name    string
+		stat    string
+		want    procStat
+		wantErr bool
+	}{
+		{"plain", "1234 (bash)" + tail, want, false},
+		{"spaces in name", "1234 (tmux: server)" + tail, want, false},
+		{"parentheses in name", "1234 (a) S 9 (b))" + tail, want, false},
+		{"trailing newline", "1234 (bash)" + tail + "\n", want, false},
+		{"negative rss", "1234 (x) S 1 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 1 0 5 0 -3", procStat{ppid: 1, start: 5}, false},
+		{"no parenthesis", "1234 bash S 1", procStat{}, true},
+		{"truncated", "1234 (bash) S 42 1234", procStat{}, true},
+		{"empty", "", procStat{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseProcStat([]byte(tt.stat))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseProcStat = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadProcessesSelf(t *testing.T) {
+	procs, err := readProcesses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	self, ok := procs[os.Getpid()]
+	if !ok {
+		t.Fatal("own process missing")
+	}
+	if self.ppid != os.Getppid() || self.rss == 0 {
+		t.Errorf("own process = %+v, want ppid %d and a resident size", self, os.Getppid())
+	}
+	if name := processName(os.Getpid()); name == "" || len(name) > 15 {
+		t.Errorf("processName = %q", name)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+// readProcesses is unavailable here; sessions report no resources.
+func readProcesses() (map[int]procStat, error) {
+	return nil, errors.New("process metrics are not supported on " + runtime.GOOS)
+}
+
+func processName(pid int) string {
+	return ""
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LaunchProfile describes what runs inside a new tmux session and which rule
+// set the poller uses to detect its state.
+type LaunchProfile struct {
+	Command  string            `yaml:"command"`  // empty: just the login shell
+	Args     []string          `yaml:"args"`     // appended to command
+	Env      map[string]string `yaml:"env"`      // set in the tmux session environment
+	Detector string            `yaml:"detector"` // rule set name (default: claude)
+}
+
+var errUnknownProfile = errors.New("unknown profile")
+
+// defaultProfile is used when create_session doesn't name one.
+const defaultProfile = "claude"
+
+var builtinProfiles = map[string]LaunchProfile{
+	"claude": {Command: "claude", Detector: defaultDetector},
+	"shell":  {Detector: "shell"},
+}
+
+// isClaude reports whether the profile launches Claude Code, which is what
+// decides if hooks and Claude-specific flags are added.
+func (p LaunchProfile) isClaude() bool {
+	return p.Command != "" && filepath.Base(p.Command) == "claude"
+}
+
+func (p LaunchProfile) detector() string {
+	if p.Detector == "" {
+		return defaultDetector
+	}
+	return p.Detector
+}
+
+// commandLine renders the shell command typed into the session: the profile
+// command and args, then extra, each shell-quoted.
+func (p LaunchProfile) commandLine(extra ...string) string {
+	if p.Command == "" {
+		return ""
+	}
+	parts := []string{p.Command}
+	for _, a := range append(append([]string{}, p.Args...), extra...) {
+		parts = append(parts, shellQuote(a))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Profile looks up a launch profile by name; config profiles override the
+// built-in ones.
+func (c *Config) Profile(name string) (LaunchProfile, error) {
+	if name == "" {
+		name = defaultProfile
+	}
+	if p, ok := c.Profiles[name]; ok {
+		return p, nil
+	}
+	if p, ok := builtinProfiles[name]; ok {
+		return p, nil
+	}
+	return LaunchProfile{}, fmt.Errorf("%w %q", errUnknownProfile, name)
+}
+
+// ProfileNames lists every profile available for create_session.
+func (c *Config) ProfileNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for name := range builtinProfiles {
+		seen[name] = true
+		names = append(names, name)
+	}
+	for name := range c.Profiles {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The /metrics endpoint serves the Prometheus text exposition format:
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+// latencyBuckets are the histogram bucket bounds for tmux commands, in
+// seconds. tmux usually answers in a few milliseconds; a loaded host or a
+// huge scrollback capture takes far longer.
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// latencyHistogram counts durations per label value into latencyBuckets.
+type latencyHistogram struct {
+	mu     sync.Mutex
+	series map[string]*latencySeries
+}
+
+type latencySeries struct {
+	buckets []uint64 // non-cumulative, one per bound
+	count   uint64
+	sum     float64
+}
+
+func (h *latencyHistogram) observe(label string, d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.series == nil {
+		h.series = make(map[string]*latencySeries)
+	}
+	s := h.series[label]
+	if s == nil {
+		s = &latencySeries{buckets: make([]uint64, len(latencyBuckets))}
+		h.series[label] = s
+	}
+	secs := d.Seconds()
+	if i := sort.SearchFloat64s(latencyBuckets, secs); i < len(latencyBuckets) {
+		s.buckets[i]++
+	}
+	s.count++
+	s.sum += secs
+}
+
+// tmuxLatency times every tmux command the agent runs, by subcommand.
+var tmuxLatency latencyHistogram
+
+// promWriter writes metric families. Write errors are left to the caller's
+// final Flush.
+type promWriter struct {
+	w *bufio.Writer
+}
+
+func (p promWriter) family(name, kind, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one sample; labels alternate names and values.
+func (p promWriter) sample(name string, value float64, labels ...string) {
+	p.w.WriteString(name)
+	if len(labels) > 0 {
+		p.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				p.w.WriteByte(',')
+			}
+			p.w.WriteString(labels[i] + `="` + promEscape(labels[i+1]) + `"`)
+		}
+		p.w.WriteByte('}')
+	}
+	p.w.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+func (p promWriter) gauge(name, help string, value float64, labels ...string) {
+	p.family(name, "gauge", help)
+	p.sample(name, value, labels...)
+}
+
+func (p promWriter) histogram(name, help, label string, h *latencyHistogram) {
+	p.family(name, "histogram", help)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += s.buckets[i]
+			p.sample(name+"_bucket", float64(cumulative), label, k, "le", strconv.FormatFloat(bound, 'g', -1, 64))
+		}
+		p.sample(name+"_bucket", float64(s.count), label, k, "le", "+Inf")
+		p.sample(name+"_sum", s.sum, label, k)
+		p.sample(name+"_count", float64(s.count), label, k)
+	}
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promEscape(s string) string {
+	return promEscaper.Replace(s)
+}
+
+// allStates are the session states, so every state series exists from the
+// start even at zero.
+var allStates = []SessionState{StateStarting, StateIdle, StateWorking, StateNeedsAttention, StateDead}
+
+// handlePrometheus serves GET /metrics. The figures are host-wide, so
+// tokens scoped to workdirs may not read them.
+func (s *Server) handlePrometheus(w http.ResponseWriter, r *http.Request) {
+	if len(principalFrom(r).Workdirs) > 0 {
+		writeAPIError(w, http.StatusForbidden, "metrics are host-wide; use a token without a workdir scope")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p := promWriter{w: bufio.NewWriter(w)}
+	defer p.w.Flush()
+
+	p.gauge("ccdash_agent_info", "Agent version and platform.", 1,
+		"version", version, "os", runtime.GOOS+"/"+runtime.GOARCH)
+
+	m := s.latestMetrics()
+	p.gauge("ccdash_cpu_percent", "Host CPU use over the last sample interval, percent of all cores.", m.CpuPercent)
+	p.family("ccdash_cpu_mode_percent", "gauge", "Host CPU use over the last sample interval by mode.")
+	p.sample("ccdash_cpu_mode_percent", m.CPU.User, "mode", "user")
+	p.sample("ccdash_cpu_mode_percent", m.CPU.System, "mode", "system")
+	p.sample("ccdash_cpu_mode_percent", m.CPU.Iowait, "mode", "iowait")
+	p.sample("ccdash_cpu_mode_percent", m.CPU.Steal, "mode", "steal")
+	p.family("ccdash_cpu_core_percent", "gauge", "CPU use of each core over the last sample interval.")
+	for i, pct := range m.CPU.Cores {
+		p.sample("ccdash_cpu_core_percent", pct, "core", strconv.Itoa(i))
+	}
+	p.gauge("ccdash_memory_total_bytes", "Host memory.", float64(m.MemTotal))
+	p.gauge("ccdash_memory_used_bytes", "Host memory in use.", float64(m.MemUsed))
+	p.gauge("ccdash_swap_total_bytes", "Swap space.", float64(m.SwapTotal))
+	p.gauge("ccdash_swap_used_bytes", "Swap space in use.", float64(m.SwapUsed))
+	p.gauge("ccdash_disk_total_bytes", "Size of the root filesystem.", float64(m.DiskTotal))
+	p.gauge("ccdash_disk_used_bytes", "Space used on the root filesystem.", float64(m.DiskUsed))
+	p.family("ccdash_filesystem_size_bytes", "gauge", "Size of each reported filesystem.")
+	for _, fs := range m.Filesystems {
+		p.sample("ccdash_filesystem_size_bytes", float64(fs.Total), "mount", fs.Mount, "device", fs.Device, "type", fs.Type)
+	}
+	p.family("ccdash_filesystem_used_bytes", "gauge", "Space used on each reported filesystem.")
+	for _, fs := range m.Filesystems {
+		p.sample("ccdash_filesystem_used_bytes", float64(fs.Used), "mount", fs.Mount, "device", fs.Device, "type", fs.Type)
+	}
+	p.family("ccdash_network_receive_bytes_total", "counter", "Bytes received per network interface since boot.")
+	for _, n := range m.Network {
+		p.sample("ccdash_network_receive_bytes_total", float64(n.RxBytes), "interface", n.Interface)
+	}
+	p.family("ccdash_network_transmit_bytes_total", "counter", "Bytes sent per network interface since boot.")
+	for _, n := range m.Network {
+		p.sample("ccdash_network_transmit_bytes_total", float64(n.TxBytes), "interface", n.Interface)
+	}
+	p.family("ccdash_temperature_celsius", "gauge", "Thermal sensor readings.")
+	for _, t := range m.Temperatures {
+		p.sample("ccdash_temperature_celsius", t.Celsius, "sensor", t.Sensor)
+	}
+	p.gauge("ccdash_uptime_seconds", "Host uptime.", float64(m.UptimeSecs))
+	p.gauge("ccdash_load1", "1-minute load average.", m.Load[0])
+	p.gauge("ccdash_load5", "5-minute load average.", m.Load[1])
+	p.gauge("ccdash_load15", "15-minute load average.", m.Load[2])
+
+	counts := make(map[SessionState]int)
+	for _, info := range s.poller.GetSessions() {
+		counts[info.State]++
+	}
+	p.family("ccdash_sessions", "gauge", "Sessions by state.")
+	for _, state := range allStates {
+		p.sample("ccdash_sessions", float64(counts[state]), "state", string(state))
+	}
+
+	transitions := s.poller.StateTransitions()
+	keys := make([]stateTransition, 0, len(transitions))
+	for k := range transitions {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].from != keys[j].from {
+			return keys[i].from < keys[j].from
+		}
+		return keys[i].to < keys[j].to
+	})
+	p.family("ccdash_session_state_transitions_total", "counter", "Session state changes seen by the poller.")
+	for _, k := range keys {
+		p.sample("ccdash_session_state_transitions_total", float64(transitions[k]), "from", string(k.from), "to", string(k.to))
+	}
+
+	models := s.costs.ModelTotals()
+	names := make([]string, 0, len(models))
+	for model := range models {
+		names = append(names, model)
+	}
+	sort.Strings(names)
+	p.family("ccdash_tokens_total", "counter", "Tokens in the usage entries read from Claude logs, by model and kind.")
+	for _, model := range names {
+		u := models[model].usage
+		p.sample("ccdash_tokens_total", float64(u.InputTokens), "model", model, "type", "input")
+		p.sample("ccdash_tokens_total", float64(u.OutputTokens), "model", model, "type", "output")
+		p.sample("ccdash_tokens_total", float64(u.CacheCreationInputTokens), "model", model, "type", "cache_creation")
+		p.sample("ccdash_tokens_total", float64(u.CacheReadInputTokens), "model", model, "type", "cache_read")
+	}
+	p.family("ccdash_messages_total", "counter", "Assistant messages in the usage entries read, by model.")
+	for _, model := range names {
+		p.sample("ccdash_messages_total", float64(models[model].usage.Messages), "model", model)
+	}
+	p.family("ccdash_cost_usd_total", "counter", "Cost of the usage entries read, by model.")
+	for _, model := range names {
+		p.sample("ccdash_cost_usd_total", models[model].cost, "model", model)
+	}
+
+	s.mu.Lock()
+	subscribers := len(s.subscribers)
+	s.mu.Unlock()
+	p.gauge("ccdash_websocket_subscribers", "Authenticated WebSocket connections.", float64(subscribers))
+
+	p.histogram("ccdash_tmux_command_duration_seconds", "Time tmux commands take, by subcommand.", "command", &tmuxLatency)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PermissionPrompt is a numbered choice dialog (e.g. "Do you want to
+// proceed?") parsed from the visible pane.
+type PermissionPrompt struct {
+	Question string         `json:"question"`
+	Options  []PromptOption `json:"options"`
+	Default  int            `json:"default"` // number of the highlighted option
+}
+
+type PromptOption struct {
+	Number int    `json:"number"`
+	Label  string `json:"label"`
+}
+
+// promptOptionRe matches a numbered option line, optionally carrying the
+// selection cursor: "❯ 1. Yes", "  2. No, and tell Claude what to do".
+var promptOptionRe = regexp.MustCompile(`^([❯›>]?)\s*(\d{1,2})\.\s+(.+)$`)
+
+// promptQuestionWindow is how far above the options we look for the question.
+const promptQuestionWindow = 6
+
+// parsePermissionPrompt extracts the bottom-most numbered option block and
+// the question above it. It returns nil if the pane shows no such dialog.
+func parsePermissionPrompt(paneText string) *PermissionPrompt {
+	lines := splitLines(paneText)
+	for i := range lines {
+		lines[i] = trimPromptLine(lines[i])
+	}
+
+	// Find the last option line, then walk up over the contiguous block.
+	end := -1
+	for i := len(lines) - 1; i >= 0; i-- {
+		if promptOptionRe.MatchString(lines[i]) {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return nil
+	}
+	start := end
+	for start > 0 && (promptOptionRe.MatchString(lines[start-1]) || lines[start-1] == "") {
+		start--
+	}
+	for start < end && lines[start] == "" {
+		start++
+	}
+
+	prompt := &PermissionPrompt{}
+	for _, line := range lines[start : end+1] {
+		m := promptOptionRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		prompt.Options = append(prompt.Options, PromptOption{Number: n, Label: m[3]})
+		if m[1] != "" {
+			prompt.Default = n
+		}
+	}
+
+	// Options must be numbered 1..N in order, or this is just a numbered list.
+	if len(prompt.Options) < 2 {
+		return nil
+	}
+	for i, opt := range prompt.Options {
+		if opt.Number != i+1 {
+			return nil
+		}
+	}
+	if prompt.Default == 0 {
+		prompt.Default = 1
+	}
+
+	for i := start - 1; i >= 0 && i >= start-promptQuestionWindow; i-- {
+		if strings.HasSuffix(lines[i], "?") {
+			prompt.Question = lines[i]
+			break
+		}
+	}
+	if prompt.Question == "" {
+		return nil
+	}
+	return prompt
+}
+
+// trimPromptLine strips whitespace and dialog box borders from a pane line.
+func trimPromptLine(line string) string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "│")
+	line = strings.TrimSuffix(line, "│")
+	return strings.TrimSpace(line)
+}
+
+// keysForOption returns the tmux keys that move the selection from the
+// prompt's current default to option and confirm it.
+func (p *PermissionPrompt) keysForOption(option int) ([]string, error) {
+	if option < 1 || option > len(p.Options) {
+		return nil, fmt.Errorf("option %d out of range 1-%d", option, len(p.Options))
+	}
+	var keys []string
+	for n := p.Default; n < option; n++ {
+		keys = append(keys, "Down")
+	}
+	for n := p.Default; n > option; n-- {
+		keys = append(keys, "Up")
+	}
+	return append(keys, "Enter"), nil
+}
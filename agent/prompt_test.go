@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestParsePermissionPrompt(t *testing.T) {
+	tests := []struct {
+		name string
+		pane string
+		want *PermissionPrompt
+	}{
+		{
+			name: "boxed dialog",
+			pane: `some output
+╭───────────────────────────────────────╮
+│ Bash command                          │
+│   rm -rf build                        │
+│ Do you want to proceed?               │
+│ ❯ 1. Yes                              │
+│   2. Yes, and don't ask again         │
+│   3. No, and tell Claude what to do   │
+╰───────────────────────────────────────╯`,
+			want: &PermissionPrompt{
+				Question: "Do you want to proceed?",
+				Options: []PromptOption{
+					{1, "Yes"},
+					{2, "Yes, and don't ask again"},
+					{3, "No, and tell Claude what to do"},
+				},
+				Default: 1,
+			},
+		},
+		{
+			name: "cursor on a later option",
+			pane: "Overwrite the file?\n\n  1. Yes\n› 2. No\n",
+			want: &PermissionPrompt{
+				Question: "Overwrite the file?",
+				Options:  []PromptOption{{1, "Yes"}, {2, "No"}},
+				Default:  2,
+			},
+		},
+		{
+			name: "no cursor defaults to the first option",
+			pane: "Continue?\n1. Yes\n2. No",
+			want: &PermissionPrompt{
+				Question: "Continue?",
+				Options:  []PromptOption{{1, "Yes"}, {2, "No"}},
+				Default:  1,
+			},
+		},
+		{
+			name: "bottom-most block wins",
+			pane: "Old question?\n1. A\n2. B\nmore output\nNew question?\n❯ 1. C\n  2. D",
+			want: &PermissionPrompt{
+				Question: "New question?",
+				Options:  []PromptOption{{1, "C"}, {2, "D"}},
+				Default:  1,
+			},
+		},
+		{"no options", "just some output\n> ", nil},
+		{"single option", "Continue?\n1. Yes", nil},
+		{"numbered list", "Steps?\n1. build\n3. test", nil},
+		{"no question", "Plan:\n1. build\n2. test", nil},
+		{"question too far up", "Proceed?\na\nb\nc\nd\ne\nf\n1. Yes\n2. No", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parsePermissionPrompt(tt.pane)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePermissionPrompt = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeysForOption(t *testing.T) {
+	prompt := &PermissionPrompt{
+		Options: []PromptOption{{1, "Yes"}, {2, "Always"}, {3, "No"}},
+		Default: 2,
+	}
+	tests := []struct {
+		option  int
+		want    []string
+		wantErr bool
+	}{
+		{1, []string{"Up", "Enter"}, false},
+		{2, []string{"Enter"}, false},
+		{3, []string{"Down", "Enter"}, false},
+		{0, nil, true},
+		{4, nil, true},
+	}
+	for _, tt := range tests {
+		keys, err := prompt.keysForOption(tt.option)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("keysForOption(%d) err = %v, want error %v", tt.option, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(keys, tt.want) {
+			t.Errorf("keysForOption(%d) = %q, want %q", tt.option, keys, tt.want)
+		}
+	}
+}
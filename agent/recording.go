@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Sessions are recorded by `ccdash-agent record`, which tmux pipe-pane runs
+// for the life of the pane, so output is captured whether or not anyone is
+// attached and across agent restarts. Files are asciicast v2:
+// https://docs.asciinema.org/manual/asciicast/v2/
+
+func defaultRecordingsDir() string {
+	return filepath.Join(agentDataDir(), "recordings")
+}
+
+// castHeader is the first line of an asciicast v2 file. The session ID and
+// workdir ride along in env so recordings outlive their sessions' metadata.
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+const (
+	castEnvSession = "TMUX_SESSION"
+	castEnvWorkdir = "PWD"
+)
+
+// RecordingInfo describes one recording file.
+type RecordingInfo struct {
+	ID        string `json:"id"`
+	SessionID string `json:"session_id"`
+	Title     string `json:"title"`
+	Workdir   string `json:"workdir"`
+	StartedAt int64  `json:"started_at"` // unix millis
+	Size      int64  `json:"size"`
+	Active    bool   `json:"active"` // session still running and recording
+}
+
+var errRecordingNotFound = errors.New("recording not found")
+
+// recordCommand renders the pipe-pane command that records sessionID into
+// dir. Recording IDs are <session>.<start millis>.
+func recordCommand(dir, sessionID, title, workdir string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("get executable path: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("creating recordings dir: %w", err)
+	}
+	file := filepath.Join(dir, fmt.Sprintf("%s.%d.cast", sessionID, time.Now().UnixMilli()))
+	command := strings.Join([]string{
+		shellQuote(exe), "record",
+		"--file", shellQuote(file),
+		"--session", shellQuote(sessionID),
+		"--title", shellQuote(title),
+		"--workdir", shellQuote(workdir),
+	}, " ")
+	// pipe-pane commands don't inherit TMUX; pass on ours so the recorder's
+	// pane size queries reach the same tmux server.
+	if t := os.Getenv("TMUX"); t != "" {
+		command = "TMUX=" + shellQuote(t) + " " + command
+	}
+	return command, nil
+}
+
+// recordingPath resolves a recording ID to its file, refusing anything that
+// isn't a plain file name inside dir.
+func recordingPath(dir, id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", errRecordingNotFound
+	}
+	path := filepath.Join(dir, id+".cast")
+	if _, err := os.Stat(path); err != nil {
+		return "", errRecordingNotFound
+	}
+	return path, nil
+}
+
+// listRecordings returns every recording in dir, newest first. active
+// reports whether a session is still alive.
+func listRecordings(dir string, active func(sessionID string) bool) []RecordingInfo {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.cast"))
+	result := []RecordingInfo{}
+	for _, path := range files {
+		info, err := readRecordingInfo(path)
+		if err != nil {
+			continue
+		}
+		info.Active = active(info.SessionID)
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartedAt > result[j].StartedAt
+	})
+	return result
+}
+
+func readRecordingInfo(path string) (RecordingInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return RecordingInfo{}, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return RecordingInfo{}, err
+	}
+
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return RecordingInfo{}, err
+	}
+	var h castHeader
+	if err := json.Unmarshal(line, &h); err != nil {
+		return RecordingInfo{}, err
+	}
+	id := strings.TrimSuffix(filepath.Base(path), ".cast")
+	startedAt := h.Timestamp * 1000
+	if i := strings.LastIndexByte(id, '.'); i >= 0 {
+		if ms, err := strconv.ParseInt(id[i+1:], 10, 64); err == nil {
+			startedAt = ms
+		}
+	}
+	return RecordingInfo{
+		ID:        id,
+		SessionID: h.Env[castEnvSession],
+		Title:     h.Title,
+		Workdir:   h.Env[castEnvWorkdir],
+		StartedAt: startedAt,
+		Size:      st.Size(),
+	}, nil
+}
+
+// pruneRecordings deletes finished recordings older than maxAge, then the
+// oldest finished ones until the total size is within maxBytes. Recordings
+// of live sessions are never deleted, since the recorder still writes them.
+func pruneRecordings(dir string, maxBytes int64, maxAge time.Duration, active func(sessionID string) bool) {
+	recs := listRecordings(dir, active)
+	var total int64
+	for _, r := range recs {
+		total += r.Size
+	}
+	// Oldest first.
+	for i := len(recs) - 1; i >= 0; i-- {
+		r := recs[i]
+		if r.Active {
+			continue
+		}
+		tooOld := maxAge > 0 && time.Since(time.UnixMilli(r.StartedAt)) > maxAge
+		tooBig := maxBytes > 0 && total > maxBytes
+		if !tooOld && !tooBig {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, r.ID+".cast")); err != nil {
+			log.Printf("recordings: %v", err)
+			continue
+		}
+		total -= r.Size
+	}
+}
+
+// recordingRetentionLoop prunes the recordings dir now and then every interval.
+func (s *Server) recordingRetentionLoop(interval time.Duration) {
+	prune := func() {
+		pruneRecordings(expandPath(s.config.RecordingsDir), int64(s.config.RecordingsMaxMB)<<20,
+			s.config.RecordingsMaxAge, s.sessionAlive)
+	}
+	prune()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		prune()
+	}
+}
+
+func (s *Server) sessionAlive(sessionID string) bool {
+	_, ok := s.poller.GetSession(sessionID)
+	return ok
+}
+
+// recordingsFor lists the recordings p may see, optionally for one session.
+func (s *Server) recordingsFor(p *principal, sessionID string) []RecordingInfo {
+	result := []RecordingInfo{}
+	for _, r := range listRecordings(expandPath(s.config.RecordingsDir), s.sessionAlive) {
+		if (sessionID == "" || r.SessionID == sessionID) && p.inScope(r.Workdir) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// openRecording opens a recording p may see. Out-of-scope recordings are
+// reported as not found.
+func (s *Server) openRecording(p *principal, id string) (*os.File, error) {
+	path, err := recordingPath(expandPath(s.config.RecordingsDir), id)
+	if err != nil {
+		return nil, err
+	}
+	info, err := readRecordingInfo(path)
+	if err != nil || !p.inScope(info.Workdir) {
+		return nil, errRecordingNotFound
+	}
+	return os.Open(path)
+}
+
+// recordResizeCheck is how often the recorder polls tmux for pane resizes
+// while output flows.
+const recordResizeCheck = time.Second
+
+// runRecordCommand implements `ccdash-agent record`, run by tmux pipe-pane:
+// it timestamps the pane output on stdin into an asciicast file until the
+// pane closes. Like the hook command it fails quietly.
+func runRecordCommand(args []string) int {
+	fs := flag.NewFlagSet("record", flag.ContinueOnError)
+	file := fs.String("file", "", "Recording file to create")
+	sessionID := fs.String("session", "", "tmux session ID")
+	title := fs.String("title", "", "Recording title")
+	workdir := fs.String("workdir", "", "Session workdir")
+	if err := fs.Parse(args); err != nil || *file == "" || *sessionID == "" {
+		io.Copy(io.Discard, os.Stdin) // never block the pane
+		return 0
+	}
+
+	f, err := os.OpenFile(*file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		io.Copy(io.Discard, os.Stdin)
+		return 0
+	}
+	defer f.Close()
+
+	start := time.Now()
+	width, height, err := paneSize(*sessionID)
+	if err != nil {
+		width, height = 200, 50
+	}
+	header, _ := json.Marshal(castHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: start.Unix(),
+		Title:     *title,
+		Env:       map[string]string{castEnvSession: *sessionID, castEnvWorkdir: *workdir},
+	})
+	f.Write(append(header, '\n'))
+
+	event := func(kind, data string) {
+		line, _ := json.Marshal([]any{
+			float64(time.Since(start).Microseconds()) / 1e6, kind, data,
+		})
+		f.Write(append(line, '\n'))
+	}
+
+	buf := make([]byte, 32*1024)
+	var pending []byte // incomplete UTF-8 sequence carried to the next read
+	lastCheck := start
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			if time.Since(lastCheck) >= recordResizeCheck {
+				lastCheck = time.Now()
+				if w, h, err := paneSize(*sessionID); err == nil && (w != width || h != height) {
+					width, height = w, h
+					event("r", fmt.Sprintf("%dx%d", w, h))
+				}
+			}
+			var out []byte
+			out, pending = splitIncompleteUTF8(append(pending, buf[:n]...))
+			if len(out) > 0 {
+				event("o", string(out))
+			}
+		}
+		if err != nil {
+			if len(pending) > 0 {
+				event("o", string(pending))
+			}
+			return 0
+		}
+	}
+}
+
+// splitIncompleteUTF8 splits b before a trailing partial UTF-8 sequence, so
+// a multi-byte character split across reads isn't turned into U+FFFD.
+func splitIncompleteUTF8(b []byte) ([]byte, []byte) {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(b[i]) {
+			continue
+		}
+		if !utf8.FullRune(b[i:]) {
+			return b[:i], append([]byte(nil), b[i:]...)
+		}
+		break
+	}
+	return b, nil
+}
+
+// maxRecordingMessage caps recordings sent over the WebSocket in one message.
+const maxRecordingMessage = 32 << 20
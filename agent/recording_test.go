@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitIncompleteUTF8(t *testing.T) {
+	euro := []byte("€")  // 3 bytes
+	emoji := []byte("😀") // 4 bytes
+	tests := []struct {
+		name       string
+		in         []byte
+		head, tail []byte
+	}{
+		{"empty", nil, nil, nil},
+		{"ascii", []byte("hello"), []byte("hello"), nil},
+		{"complete multibyte", []byte("a€"), []byte("a€"), nil},
+		{"one byte of three", append([]byte("a"), euro[:1]...), []byte("a"), euro[:1]},
+		{"two bytes of three", append([]byte("a"), euro[:2]...), []byte("a"), euro[:2]},
+		{"three bytes of four", append([]byte("ab"), emoji[:3]...), []byte("ab"), emoji[:3]},
+		{"only a partial rune", emoji[:2], []byte{}, emoji[:2]},
+		{"stray continuation byte", []byte("a\x80"), []byte("a\x80"), nil},
+		{"invalid lead byte", []byte("a\xff"), []byte("a\xff"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head, tail := splitIncompleteUTF8(tt.in)
+			if !bytes.Equal(head, tt.head) || !bytes.Equal(tail, tt.tail) {
+				t.Errorf("splitIncompleteUTF8(%q) = %q, %q, want %q, %q", tt.in, head, tail, tt.head, tt.tail)
+			}
+		})
+	}
+}
+
+func TestRecordingPath(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "recordings")
+	id := "cc-1-a.1700000000000"
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, id+".cast"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// A recording outside dir that traversal would reach.
+	if err := os.WriteFile(filepath.Join(base, "outside.cast"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		id   string
+		ok   bool
+	}{
+		{"existing", id, true},
+		{"missing", "cc-2-b.1700000000000", false},
+		{"empty", "", false},
+		{"parent dir", "../outside", false},
+		{"nested", "sub/" + id, false},
+		{"backslash", `..\outside`, false},
+		{"hidden", ".cast", false},
+		{"absolute", filepath.Join(dir, id), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := recordingPath(dir, tt.id)
+			if tt.ok {
+				if err != nil || path != filepath.Join(dir, id+".cast") {
+					t.Errorf("recordingPath(%q) = %q, %v", tt.id, path, err)
+				}
+				return
+			}
+			if !errors.Is(err, errRecordingNotFound) {
+				t.Errorf("recordingPath(%q) = %q, %v, want errRecordingNotFound", tt.id, path, err)
+			}
+		})
+	}
+}
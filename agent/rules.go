@@ -0,0 +1,156 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// rulesFile is the on-disk format of state_rules_file. It uses the same key
+// as agent.yaml so a block can be moved between the two unchanged.
+type rulesFile struct {
+	StateRules []StateRule `yaml:"state_rules"`
+}
+
+// loadStateRules compiles the rule sets configured in cfg. The claude
+// detector comes from the rules file, inline state_rules or the built-in
+// rules, in that order; rule_sets adds or overrides other detectors.
+func loadStateRules(cfg *Config) (ruleSets, error) {
+	sets := builtinRuleSets()
+
+	rules := cfg.StateRules
+	if cfg.StateRulesFile != "" {
+		data, err := os.ReadFile(expandPath(cfg.StateRulesFile))
+		if err != nil {
+			return nil, fmt.Errorf("reading rules file: %w", err)
+		}
+		var rf rulesFile
+		if err := yaml.Unmarshal(data, &rf); err != nil {
+			return nil, fmt.Errorf("parsing rules file: %w", err)
+		}
+		rules = rf.StateRules
+	}
+	if len(rules) > 0 {
+		rs, err := compileRules(rules)
+		if err != nil {
+			return nil, err
+		}
+		sets[defaultDetector] = rs
+	}
+
+	for name, rules := range cfg.RuleSets {
+		rs, err := compileRules(rules)
+		if err != nil {
+			return nil, fmt.Errorf("rule set %q: %w", name, err)
+		}
+		sets[name] = rs
+	}
+	return sets, nil
+}
+
+// watchStateRules reloads state rules whenever the config file or the rules
+// file it points to changes. Invalid rules are logged and the previous set is
+// kept.
+func watchStateRules(cfgPath string, cfg *Config, interval time.Duration) {
+	rulesPath := expandPath(cfg.StateRulesFile)
+	cfgMod, rulesMod := modTime(cfgPath), modTime(rulesPath)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		newCfgMod, newRulesMod := modTime(cfgPath), modTime(rulesPath)
+		if newCfgMod.Equal(cfgMod) && newRulesMod.Equal(rulesMod) {
+			continue
+		}
+
+		fresh, err := loadConfig(cfgPath)
+		if err != nil {
+			log.Printf("state rules: reload: %v", err)
+			cfgMod, rulesMod = newCfgMod, newRulesMod
+			continue
+		}
+		sets, err := loadStateRules(fresh)
+		if err != nil {
+			log.Printf("state rules: reload: %v (keeping previous rules)", err)
+		} else {
+			setStateRules(sets)
+			log.Printf("state rules: reloaded %d rule sets", len(sets))
+		}
+
+		// The config may now point at a different rules file.
+		rulesPath = expandPath(fresh.StateRulesFile)
+		cfgMod, rulesMod = modTime(cfgPath), modTime(rulesPath)
+	}
+}
+
+func modTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// describeMatch renders the outcome of a rule evaluation for humans.
+func describeMatch(state SessionState, rule *StateRule) string {
+	if rule == nil {
+		return fmt.Sprintf("state: %s (no rule matched)", state)
+	}
+	return fmt.Sprintf("state: %s\nrule:  %s\nregex: %s", state, rule.Name, rule.Pattern)
+}
+
+// runTestRulesCommand implements `ccdash-agent test-rules`: it runs the
+// configured state rules against a saved pane capture and reports which rule
+// fired.
+func runTestRulesCommand(args []string) int {
+	fs := flag.NewFlagSet("test-rules", flag.ExitOnError)
+	configPath := fs.String("config", defaultConfigPath(), "Path to config file")
+	detector := fs.String("detector", defaultDetector, "Rule set to evaluate")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ccdash-agent test-rules [-config path] [-detector name] <capture-file | ->")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+	sets, err := loadStateRules(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid state rules: %v\n", err)
+		return 1
+	}
+	rs, ok := sets[*detector]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown detector %q\n", *detector)
+		return 1
+	}
+
+	var capture []byte
+	if fs.Arg(0) == "-" {
+		capture, err = io.ReadAll(os.Stdin)
+	} else {
+		capture, err = os.ReadFile(fs.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read capture: %v\n", err)
+		return 1
+	}
+
+	fmt.Println(describeMatch(rs.detect(string(capture))))
+	return 0
+}
@@ -7,8 +7,9 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -33,14 +34,50 @@ func (c *safeConn) safeWrite(messageType int, data []byte) error {
 
 // Client → Agent messages
 type ClientMessage struct {
-	Type                       string `json:"type"`
-	SessionID                  string `json:"session_id,omitempty"`
-	Workdir                    string `json:"workdir,omitempty"`
-	Name                       string `json:"name,omitempty"`
-	Data                       string `json:"data,omitempty"` // base64
-	Cols                       int    `json:"cols,omitempty"`
-	Rows                       int    `json:"rows,omitempty"`
-	DangerouslySkipPermissions bool   `json:"dangerously_skip_permissions,omitempty"`
+	Type                       string   `json:"type"`
+	SessionID                  string   `json:"session_id,omitempty"`
+	Workdir                    string   `json:"workdir,omitempty"`
+	Name                       string   `json:"name,omitempty"`
+	Data                       string   `json:"data,omitempty"` // base64
+	Cols                       int      `json:"cols,omitempty"`
+	Rows                       int      `json:"rows,omitempty"`
+	DangerouslySkipPermissions bool     `json:"dangerously_skip_permissions,omitempty"`
+	Profile                    string   `json:"profile,omitempty"`       // launch profile for create_session
+	Args                       []string `json:"args,omitempty"`          // extra args appended to the profile command
+	ReadOnly                   bool     `json:"read_only,omitempty"`     // attach as viewer, never driver
+	HistoryLines               int      `json:"history_lines,omitempty"` // scrollback to replay on attach
+	Tags                       []string `json:"tags,omitempty"`          // for set_tags
+	Note                       string   `json:"note,omitempty"`          // for set_note
+	SessionIDs                 []string `json:"session_ids,omitempty"`   // send_prompt to several sessions
+	Text                       string   `json:"text,omitempty"`          // prompt text for send_prompt
+	Submit                     bool     `json:"submit,omitempty"`        // press Enter after the prompt
+	RequireIdle                bool     `json:"require_idle,omitempty"`  // only send to idle sessions
+	Option                     int      `json:"option,omitempty"`        // respond_prompt choice (1-based)
+
+	Recording    string `json:"recording,omitempty"`       // get_recording ID
+	Conversation string `json:"conversation_id,omitempty"` // Claude session ID, for get_events
+
+	// create_session: resume a Claude conversation, by ID or the workdir's
+	// latest, optionally forking it under a new ID
+	ResumeConversation   string `json:"resume_conversation,omitempty"`
+	ContinueConversation bool   `json:"continue_conversation,omitempty"`
+	ForkConversation     bool   `json:"fork_conversation,omitempty"`
+
+	// UsageCursor in the auth message asks for the usage entries since a
+	// cursor from an earlier usage_entries message; "" asks for all of them.
+	UsageCursor *string `json:"usage_cursor,omitempty"`
+
+	// get_audit filters; Since is also the usage_since cursor
+	Since  string `json:"since,omitempty"` // RFC 3339
+	Until  string `json:"until,omitempty"` // RFC 3339
+	Token  string `json:"token_name,omitempty"`
+	Action string `json:"action,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+
+	// metrics_history: a range ending now (or since/until) and a step,
+	// both durations such as "6h" and "1m"
+	Range string `json:"range,omitempty"`
+	Step  string `json:"step,omitempty"`
 }
 
 // Agent → Client messages
@@ -54,8 +91,17 @@ type ServerMessage struct {
 	OS       string         `json:"os,omitempty"`
 	Version  string         `json:"version,omitempty"`
 	Dirs     []string       `json:"dirs,omitempty"`
+	Profiles []string       `json:"profiles,omitempty"`
 	Message  string         `json:"message,omitempty"`
 
+	// State rule evaluation (included with rules_result)
+	State SessionState `json:"state,omitempty"`
+	Rule  string       `json:"rule,omitempty"`
+
+	// Shared terminal role (included with terminal_role)
+	Role    string `json:"role,omitempty"`
+	Viewers int    `json:"viewers,omitempty"`
+
 	// System metrics (included with machine_info)
 	CpuPercent float64 `json:"cpu_percent,omitempty"`
 	MemTotal   uint64  `json:"mem_total,omitempty"`
@@ -70,23 +116,56 @@ type ServerMessage struct {
 type UsageMessage struct {
 	Type    string       `json:"type"`
 	Entries []UsageEntry `json:"entries"`
+	Cursor  string       `json:"cursor,omitempty"` // latest entry timestamp, for usage_since
+}
+
+// RecordingsMessage answers list_recordings.
+type RecordingsMessage struct {
+	Type       string          `json:"type"`
+	Recordings []RecordingInfo `json:"recordings"`
+}
+
+// AuditMessage answers get_audit.
+type AuditMessage struct {
+	Type   string       `json:"type"`
+	Events []AuditEvent `json:"events"`
 }
 
 type Server struct {
 	config   *Config
+	auth     *authenticator
+	audit    *auditLog
 	poller   *Poller
 	usage    *UsageScanner
+	events   *eventLog // nil unless transcript_events is on
 	upgrader websocket.Upgrader
 
 	mu          sync.Mutex
-	subscribers map[*safeConn]bool
+	subscribers map[*safeConn]*principal
+
+	termMu    sync.Mutex
+	terminals map[string]*sharedTerminal // tmux session -> shared PTY
+
+	costs         *costTracker
+	conversations *conversationIndex
+	budgetMu      sync.Mutex
+	budgetFired   map[string]bool // session + "\x00" + budget name
+
+	metricsMu   sync.Mutex
+	lastMetrics Metrics // latest sample from metricsBroadcastLoop
+	history     *metricsHistory
 }
 
-func newServer(config *Config, poller *Poller) *Server {
+func newServer(config *Config, auth *authenticator, audit *auditLog, poller *Poller) *Server {
 	s := &Server{
 		config:      config,
+		auth:        auth,
+		audit:       audit,
 		poller:      poller,
-		subscribers: make(map[*safeConn]bool),
+		subscribers: make(map[*safeConn]*principal),
+		terminals:   make(map[string]*sharedTerminal),
+		costs:       newCostTracker(newPricingTable(config.Pricing), config.CostWindow),
+		budgetFired: make(map[string]bool),
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(_ *http.Request) bool {
 				return true // Auth handled post-upgrade via first WS message
@@ -95,17 +174,49 @@ func newServer(config *Config, poller *Poller) *Server {
 	}
 
 	poller.onChange = func(sessions []*SessionInfo) {
+		s.enforceBudgets(sessions)
 		s.broadcastSessions(sessions)
 	}
+	poller.annotate = s.costs.annotate
+	s.conversations = newConversationIndex(s.costs.pricing)
+	poller.detectorFor = func(profile string) string {
+		p, err := config.Profile(profile)
+		if err != nil {
+			return defaultDetector
+		}
+		return p.detector()
+	}
+	poller.Start(500 * time.Millisecond) // only once the callbacks are set
 
 	// Usage scanner — reads JSONL logs and broadcasts new entries.
-	s.usage = newUsageScanner(poller)
+	s.usage = newUsageScanner(poller, defaultUsageOffsetsPath())
+	s.usage.scanAll = config.UsageScanAll
+	s.usage.include = expandPaths(config.UsageInclude)
+	s.usage.exclude = expandPaths(config.UsageExclude)
+	s.usage.onReplay = s.costs.Add
 	s.usage.onChange = func(entries []UsageEntry) {
+		s.costs.Add(entries)
 		s.broadcastUsageEntries(entries)
 	}
+	if config.TranscriptEvents {
+		s.events = &eventLog{}
+		s.usage.events = newTranscriptParser()
+		s.usage.onEvents = func(events []TranscriptEvent) {
+			s.events.Add(events)
+			s.broadcastTranscriptEvents(events)
+		}
+	}
 	s.usage.Start(10 * time.Second)
 
+	historyPath := ""
+	if config.MetricsHistoryPersist {
+		historyPath = defaultMetricsHistoryPath()
+	}
+	s.history = newMetricsHistory(config.MetricsHistory, historyPath)
 	go s.metricsBroadcastLoop()
+	if config.RecordSessions {
+		go s.recordingRetentionLoop(10 * time.Minute)
+	}
 
 	return s
 }
@@ -115,19 +226,13 @@ func (s *Server) isAllowedWorkdir(workdir string) bool {
 	if len(dirs) == 0 {
 		return true // no restriction configured
 	}
-	clean := filepath.Clean(workdir)
-	for _, allowed := range dirs {
-		allowedClean := filepath.Clean(allowed)
-		if clean == allowedClean || strings.HasPrefix(clean, allowedClean+string(filepath.Separator)) {
-			return true
-		}
-	}
-	return false
+	return workdirWithin(workdir, dirs)
 }
 
 func (s *Server) Handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", s.handleWebSocket)
+	s.registerAPI(mux)
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
@@ -146,34 +251,49 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn := &safeConn{Conn: raw}
 
 	// First message must be auth
-	if s.config.Token != "" {
+	p := anonymous
+	var usageCursor *string
+	if s.auth.required() {
 		_, data, err := conn.ReadMessage()
 		if err != nil {
 			return
 		}
 		var msg ClientMessage
-		if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "auth" || msg.Data != s.config.Token {
+		if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "auth" {
+			s.sendError(conn, "unauthorized")
+			return
+		}
+		var ok bool
+		if p, ok = s.auth.authenticate(msg.Data); !ok {
+			s.audit.Record(AuditEvent{Remote: r.RemoteAddr, Action: "auth", Outcome: "denied"})
 			s.sendError(conn, "unauthorized")
 			return
 		}
+		usageCursor = msg.UsageCursor
 	}
 
-	s.addSubscriber(conn)
+	s.addSubscriber(conn, p)
 	defer s.removeSubscriber(conn)
 
 	// Send initial state
-	sessions := s.poller.GetSessions()
+	sessions := p.filterSessions(s.poller.GetSessions())
 	s.sendMessage(conn, ServerMessage{Type: "sessions", Sessions: sessions})
 
-	// Re-scan all usage files so new subscriber gets historical data.
-	// Dashboard deduplicates via skipDuplicates on DB insert.
-	go s.usage.RescanAll()
+	// Catch the client up on usage it hasn't seen; live entries follow as
+	// usage_entries broadcasts.
+	if usageCursor != nil {
+		go s.sendUsageSince(conn, p, *usageCursor)
+	}
 
-	var terminal *TerminalSession
+	var terminal *sharedTerminal
 
 	defer func() {
 		if terminal != nil {
-			terminal.Close()
+			s.detachTerminal(conn, terminal)
+			s.audit.Record(AuditEvent{
+				Remote: r.RemoteAddr, Token: p.Name, Action: "detach",
+				SessionID: terminal.sessionID, Detail: "disconnected", Outcome: "ok",
+			})
 		}
 	}()
 
@@ -189,41 +309,73 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
+		// audit records the outcome of a control action.
+		audit := func(sessionID, detail string, err error) {
+			s.audit.Record(AuditEvent{
+				Remote: r.RemoteAddr, Token: p.Name, Action: msg.Type,
+				SessionID: sessionID, Detail: detail, Outcome: outcome(err),
+			})
+		}
+
+		// Tokens can be revoked or expire while connected.
+		if !s.auth.valid(p) {
+			s.sendError(conn, "unauthorized")
+			return
+		}
+		if role := requiredRole(msg.Type); !p.allows(role) {
+			// Keystrokes from read-only viewers are dropped like any
+			// non-driver's, without an error per key.
+			if msg.Type != "input" && msg.Type != "resize" {
+				s.sendError(conn, "forbidden: "+msg.Type+" requires "+string(role))
+			}
+			if auditedActions[msg.Type] {
+				audit(msg.SessionID, "", errDenied)
+			}
+			continue
+		}
+		if !s.canAccessSessions(p, msg) {
+			s.sendError(conn, "forbidden: session outside token scope")
+			if auditedActions[msg.Type] {
+				audit(msg.SessionID, "", errDenied)
+			}
+			continue
+		}
+
 		switch msg.Type {
+		case "auth":
+			// Without tokens there is no auth handshake, but clients still
+			// send one; treat it as the hello it otherwise is.
+			if msg.UsageCursor != nil {
+				go s.sendUsageSince(conn, p, *msg.UsageCursor)
+			}
+
+		case "usage_since":
+			go s.sendUsageSince(conn, p, msg.Since)
+
 		case "list_sessions":
-			sessions := s.poller.GetSessions()
+			sessions := p.filterSessions(s.poller.GetSessions())
 			s.sendMessage(conn, ServerMessage{Type: "sessions", Sessions: sessions})
 
 		case "create_session":
-			workdir := msg.Workdir
-			if workdir == "" {
-				home, _ := os.UserHomeDir()
-				workdir = home
-			}
-			// Expand ~ to home directory (exec.Command doesn't do shell expansion)
-			if len(workdir) > 0 && workdir[0] == '~' {
-				home, _ := os.UserHomeDir()
-				workdir = home + workdir[1:]
-			}
-			if !s.isAllowedWorkdir(workdir) {
-				s.sendError(conn, "workdir not allowed")
-				continue
-			}
-			name := msg.Name
-			if name == "" {
-				name = "session"
-			}
-			sessionID, err := createTmuxSession(name, workdir, s.config.HistoryLimit, msg.DangerouslySkipPermissions)
+			sessionID, name, err := s.createSession(createSessionRequest{
+				Workdir:                    msg.Workdir,
+				Name:                       msg.Name,
+				Profile:                    msg.Profile,
+				Args:                       msg.Args,
+				DangerouslySkipPermissions: msg.DangerouslySkipPermissions,
+				ResumeConversation:         msg.ResumeConversation,
+				ContinueConversation:       msg.ContinueConversation,
+				ForkConversation:           msg.ForkConversation,
+			}, p)
+			audit(sessionID, msg.Workdir, err)
 			if err != nil {
-				log.Printf("create_session error: %v", err)
-				s.sendError(conn, "failed to create session")
+				s.sendError(conn, err.Error())
 				continue
 			}
-			s.poller.TrackSession(sessionID, workdir)
 			s.sendMessage(conn, ServerMessage{
 				Type:    "session_created",
 				Session: sessionID,
-				Name:    sessionID,
+				Name:    name,
 			})
 
 		case "kill_session":
@@ -231,88 +383,268 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 				s.sendError(conn, "session_id required")
 				continue
 			}
-			log.Printf("kill_session: %q", msg.SessionID)
-			if err := killTmuxSession(msg.SessionID); err != nil {
-				log.Printf("kill_session error: %v", err)
-				s.sendError(conn, "failed to kill session")
-			} else {
-				log.Printf("kill_session: success")
-				s.poller.RemoveSession(msg.SessionID)
-				s.broadcastSessions(s.poller.GetSessions())
+			err := s.killSession(msg.SessionID)
+			audit(msg.SessionID, "", err)
+			if err != nil {
+				s.sendError(conn, err.Error())
+			}
+
+		case "rename_session":
+			name := strings.TrimSpace(msg.Name)
+			if msg.SessionID == "" || name == "" {
+				s.sendError(conn, "session_id and name required")
+				continue
+			}
+			err := s.updateSessionMeta(msg.SessionID, func(m *SessionMeta) {
+				m.Name = truncateUTF8(name, maxDisplayNameRunes)
+			})
+			audit(msg.SessionID, name, err)
+			if err != nil {
+				s.sendError(conn, err.Error())
 			}
 
+		case "set_tags":
+			if msg.SessionID == "" {
+				s.sendError(conn, "session_id required")
+				continue
+			}
+			tags := normalizeTags(msg.Tags)
+			err := s.updateSessionMeta(msg.SessionID, func(m *SessionMeta) {
+				m.Tags = tags
+			})
+			audit(msg.SessionID, strings.Join(tags, ","), err)
+			if err != nil {
+				s.sendError(conn, err.Error())
+			}
+
+		case "set_note":
+			if msg.SessionID == "" {
+				s.sendError(conn, "session_id required")
+				continue
+			}
+			note := truncateUTF8(strings.TrimSpace(msg.Note), maxNoteRunes)
+			err := s.updateSessionMeta(msg.SessionID, func(m *SessionMeta) {
+				m.Note = note
+			})
+			audit(msg.SessionID, "", err)
+			if err != nil {
+				s.sendError(conn, err.Error())
+			}
+
+		case "send_prompt":
+			targets := msg.SessionIDs
+			if msg.SessionID != "" {
+				targets = append([]string{msg.SessionID}, targets...)
+			}
+			if len(targets) == 0 || (msg.Text == "" && !msg.Submit) {
+				s.sendError(conn, "session_id and text required")
+				continue
+			}
+			// Each send waits for the paste before Enter; do them side by
+			// side so N targets don't hold up the connection N times over.
+			var wg sync.WaitGroup
+			seen := make(map[string]bool)
+			for _, id := range targets {
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+				wg.Go(func() {
+					result := ServerMessage{Type: "prompt_result", Session: id, Message: "sent"}
+					err := s.sendPrompt(id, msg.Text, msg.Submit, msg.RequireIdle)
+					audit(id, "", err)
+					if err != nil {
+						result.Message = err.Error()
+					}
+					s.sendMessage(conn, result)
+				})
+			}
+			wg.Wait()
+
+		case "respond_prompt":
+			if msg.SessionID == "" || msg.Option == 0 {
+				s.sendError(conn, "session_id and option required")
+				continue
+			}
+			result := ServerMessage{Type: "prompt_result", Session: msg.SessionID, Message: "sent"}
+			err := s.respondPrompt(msg.SessionID, msg.Option)
+			audit(msg.SessionID, strconv.Itoa(msg.Option), err)
+			if err != nil {
+				result.Message = err.Error()
+			}
+			s.sendMessage(conn, result)
+
 		case "attach":
 			if msg.SessionID == "" {
 				s.sendError(conn, "session_id required")
 				continue
 			}
 			if terminal != nil {
-				terminal.Close()
+				s.detachTerminal(conn, terminal)
+				terminal = nil
+			}
+			if !p.allows(RoleOperator) {
+				msg.ReadOnly = true
+			}
+			st, err := s.attachTerminal(conn, msg)
+			detail := "driver"
+			if msg.ReadOnly {
+				detail = "read_only"
 			}
-			terminal = newTerminalSession()
-			cols := uint16(msg.Cols)
-			rows := uint16(msg.Rows)
-			if err := terminal.Attach(msg.SessionID, cols, rows); err != nil {
+			audit(msg.SessionID, detail, err)
+			if err != nil {
 				s.sendError(conn, err.Error())
-				terminal = nil
 				continue
 			}
-			// Start reading from PTY
-			go s.readPTY(conn, terminal)
+			terminal = st
 
 		case "detach":
 			if terminal != nil {
-				terminal.Detach()
+				s.detachTerminal(conn, terminal)
+				audit(terminal.sessionID, "", nil)
 				terminal = nil
 			}
 
-		case "input":
+		case "take_control":
 			if terminal == nil {
+				s.sendError(conn, "not attached")
+				continue
+			}
+			terminal.setDriver(conn)
+			terminal.notifyRoles()
+			audit(terminal.sessionID, "", nil)
+
+		case "input":
+			// Viewers are read-only; only the driver types into the PTY.
+			if terminal == nil || !terminal.isDriver(conn) {
 				continue
 			}
 			decoded, err := base64.StdEncoding.DecodeString(msg.Data)
 			if err != nil {
 				continue
 			}
-			terminal.Write(decoded)
+			terminal.term.Write(decoded)
+			s.poller.AckBudget(terminal.sessionID)
 
 		case "resize":
-			if terminal == nil {
+			if terminal == nil || !terminal.isDriver(conn) {
 				continue
 			}
 			if msg.Cols > 0 && msg.Rows > 0 {
-				terminal.Resize(uint16(msg.Cols), uint16(msg.Rows))
+				terminal.term.Resize(uint16(msg.Cols), uint16(msg.Rows))
+			}
+
+		case "test_rules":
+			// Evaluate the active rules against a supplied capture (base64)
+			// or, failing that, the live pane of session_id.
+			var capture string
+			if msg.Data != "" {
+				decoded, err := base64.StdEncoding.DecodeString(msg.Data)
+				if err != nil {
+					s.sendError(conn, "invalid capture data")
+					continue
+				}
+				capture = string(decoded)
+			} else if msg.SessionID != "" {
+				if msg.Profile == "" {
+					msg.Profile = s.poller.SessionProfile(msg.SessionID)
+				}
+				pane, err := capturePaneVisible(msg.SessionID)
+				if err != nil {
+					s.sendError(conn, "failed to capture pane")
+					continue
+				}
+				capture = pane
+			} else {
+				s.sendError(conn, "data or session_id required")
+				continue
+			}
+			state, rule := rulesFor(s.poller.detectorFor(msg.Profile)).detect(capture)
+			result := ServerMessage{Type: "rules_result", Session: msg.SessionID, State: state}
+			if rule != nil {
+				result.Rule = rule.Name
 			}
+			s.sendMessage(conn, result)
 
 		case "machine_info":
-			hostname, _ := os.Hostname()
-			m := CollectMetrics()
+			s.sendMessage(conn, s.machineInfo().message())
+
+		case "metrics":
+			s.sendJSON(conn, s.latestMetrics().message())
+
+		case "metrics_history":
+			q, err := msg.historyQuery()
+			if err != nil {
+				s.sendError(conn, err.Error())
+				continue
+			}
+			s.sendJSON(conn, s.history.message(q))
+
+		case "list_recordings":
+			s.sendJSON(conn, RecordingsMessage{Type: "recordings", Recordings: s.recordingsFor(p, msg.SessionID)})
+
+		case "get_recording":
+			// The whole asciicast file, base64 in data; large recordings
+			// are better fetched from GET /api/v1/recordings/{id}.
+			f, err := s.openRecording(p, msg.Recording)
+			if err != nil {
+				s.sendError(conn, err.Error())
+				continue
+			}
+			cast, err := io.ReadAll(io.LimitReader(f, maxRecordingMessage+1))
+			f.Close()
+			if err != nil || len(cast) > maxRecordingMessage {
+				s.sendError(conn, "recording too large; use GET /api/v1/recordings/"+msg.Recording)
+				continue
+			}
 			s.sendMessage(conn, ServerMessage{
-				Type:       "machine_info",
-				Hostname:   hostname,
-				OS:         runtime.GOOS + "/" + runtime.GOARCH,
-				Version:    version,
-				Dirs:       s.config.ExpandWorkdirs(),
-				CpuPercent: m.CpuPercent,
-				MemTotal:   m.MemTotal,
-				MemUsed:    m.MemUsed,
-				DiskTotal:  m.DiskTotal,
-				DiskUsed:   m.DiskUsed,
-				UptimeSecs: m.UptimeSecs,
-				LoadAvg:    m.LoadAvg,
+				Type: "recording",
+				Name: msg.Recording,
+				Data: base64.StdEncoding.EncodeToString(cast),
 			})
 
+		case "get_audit":
+			filter, err := msg.auditFilter()
+			if err != nil {
+				s.sendError(conn, err.Error())
+				continue
+			}
+			s.sendJSON(conn, AuditMessage{Type: "audit", Events: s.audit.Query(filter)})
+
+		case "get_events":
+			if s.events == nil {
+				s.sendError(conn, errEventsDisabled.Error())
+				continue
+			}
+			filter, err := msg.eventFilter()
+			if err != nil {
+				s.sendError(conn, err.Error())
+				continue
+			}
+			s.sendJSON(conn, TranscriptMessage{Type: "transcript_events", Events: s.events.Query(p, filter)})
+
+		case "list_conversations":
+			convs, err := s.listConversations(p, msg.Workdir, msg.Limit)
+			if err != nil {
+				s.sendError(conn, err.Error())
+				continue
+			}
+			s.sendJSON(conn, ConversationsMessage{Type: "conversations", Conversations: convs})
+
 		case "self_update":
 			go func() {
 				log.Println("Self-update requested via WebSocket")
 				s.sendMessage(conn, ServerMessage{Type: "update_status", Message: "downloading"})
-				if err := selfUpdate(); err != nil {
+				err := selfUpdate()
+				audit("", version, err)
+				if err != nil {
 					log.Printf("Self-update failed: %v", err)
 					s.sendMessage(conn, ServerMessage{Type: "update_status", Message: "error: " + err.Error()})
 					return
 				}
 				s.sendMessage(conn, ServerMessage{Type: "update_status", Message: "restarting"})
 				log.Println("Self-update complete, exiting for restart")
+				s.audit.Close()
 				os.Exit(0)
 			}()
 
@@ -322,7 +654,11 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) readPTY(conn *safeConn, terminal *TerminalSession) {
+// readPTY pumps the shared PTY and fans its output out to every viewer.
+func (s *Server) readPTY(st *sharedTerminal) {
+	defer s.dropTerminal(st)
+	terminal := st.term
+
 	// Buffer PTY output and flush at most every 16ms to reduce flickering
 	buf := make([]byte, 32*1024)
 	var accumulated []byte
@@ -356,10 +692,14 @@ func (s *Server) readPTY(conn *safeConn, terminal *TerminalSession) {
 			return
 		}
 		encoded := base64.StdEncoding.EncodeToString(accumulated)
-		s.sendMessage(conn, ServerMessage{
-			Type: "output",
-			Data: encoded,
+		data, err := json.Marshal(ServerMessage{
+			Type:    "output",
+			Session: st.sessionID,
+			Data:    encoded,
 		})
+		if err == nil {
+			st.broadcast(data)
+		}
 		accumulated = accumulated[:0]
 	}
 
@@ -400,14 +740,23 @@ func (s *Server) sendMessage(conn *safeConn, msg ServerMessage) {
 	conn.safeWrite(websocket.TextMessage, data)
 }
 
+// sendJSON writes any message struct, for replies that aren't a ServerMessage.
+func (s *Server) sendJSON(conn *safeConn, msg any) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	conn.safeWrite(websocket.TextMessage, data)
+}
+
 func (s *Server) sendError(conn *safeConn, message string) {
 	s.sendMessage(conn, ServerMessage{Type: "error", Message: message})
 }
 
-func (s *Server) addSubscriber(conn *safeConn) {
+func (s *Server) addSubscriber(conn *safeConn, p *principal) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.subscribers[conn] = true
+	s.subscribers[conn] = p
 }
 
 func (s *Server) removeSubscriber(conn *safeConn) {
@@ -416,28 +765,67 @@ func (s *Server) removeSubscriber(conn *safeConn) {
 	delete(s.subscribers, conn)
 }
 
+// metricsBroadcastLoop samples host metrics every 5s, records them in the
+// history and broadcasts them as machine_info and metrics messages.
+// Requests between broadcasts are answered from the latest sample, so CPU
+// and network rates always cover a full interval.
 func (s *Server) metricsBroadcastLoop() {
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := time.NewTicker(metricsInterval)
 	defer ticker.Stop()
 
 	// Prime the CPU delta tracker so the first real broadcast has data.
-	CollectMetrics()
+	s.sampleMetrics()
 
 	for range ticker.C {
-		s.broadcastMachineInfo()
+		m := s.sampleMetrics()
+		s.history.Add(m)
+		s.broadcast(s.machineInfo().message())
+		s.broadcast(m.message())
 	}
 }
 
-func (s *Server) broadcastMachineInfo() {
-	hostname, _ := os.Hostname()
-	m := CollectMetrics()
+// sampleMetrics collects host metrics and keeps them as the latest sample.
+func (s *Server) sampleMetrics() Metrics {
+	m := CollectMetrics(s.config.MetricsFilesystems)
+	m.At = time.Now()
+	s.metricsMu.Lock()
+	s.lastMetrics = m
+	s.metricsMu.Unlock()
+	return m
+}
 
-	msg := ServerMessage{
-		Type:       "machine_info",
+// latestMetrics returns the most recent sample of host metrics.
+func (s *Server) latestMetrics() Metrics {
+	s.metricsMu.Lock()
+	defer s.metricsMu.Unlock()
+	return s.lastMetrics
+}
+
+// MachineInfo describes the host the agent runs on.
+type MachineInfo struct {
+	Hostname   string   `json:"hostname"`
+	OS         string   `json:"os"`
+	Version    string   `json:"version"`
+	Dirs       []string `json:"dirs"`
+	Profiles   []string `json:"profiles"`
+	CpuPercent float64  `json:"cpu_percent"`
+	MemTotal   uint64   `json:"mem_total"`
+	MemUsed    uint64   `json:"mem_used"`
+	DiskTotal  uint64   `json:"disk_total"`
+	DiskUsed   uint64   `json:"disk_used"`
+	UptimeSecs uint64   `json:"uptime_secs"`
+	LoadAvg    float64  `json:"load_avg"`
+}
+
+func (s *Server) machineInfo() MachineInfo {
+	hostname, _ := os.Hostname()
+	m := s.latestMetrics()
+	return MachineInfo{
 		Hostname:   hostname,
 		OS:         runtime.GOOS + "/" + runtime.GOARCH,
 		Version:    version,
 		Dirs:       s.config.ExpandWorkdirs(),
+		Profiles:   s.config.ProfileNames(),
 		CpuPercent: m.CpuPercent,
 		MemTotal:   m.MemTotal,
 		MemUsed:    m.MemUsed,
@@ -446,7 +834,29 @@ func (s *Server) broadcastMachineInfo() {
 		UptimeSecs: m.UptimeSecs,
 		LoadAvg:    m.LoadAvg,
 	}
+}
 
+// message wraps mi in a machine_info WebSocket message.
+func (mi MachineInfo) message() ServerMessage {
+	return ServerMessage{
+		Type:       "machine_info",
+		Hostname:   mi.Hostname,
+		OS:         mi.OS,
+		Version:    mi.Version,
+		Dirs:       mi.Dirs,
+		Profiles:   mi.Profiles,
+		CpuPercent: mi.CpuPercent,
+		MemTotal:   mi.MemTotal,
+		MemUsed:    mi.MemUsed,
+		DiskTotal:  mi.DiskTotal,
+		DiskUsed:   mi.DiskUsed,
+		UptimeSecs: mi.UptimeSecs,
+		LoadAvg:    mi.LoadAvg,
+	}
+}
+
+// broadcast sends msg to every subscriber.
+func (s *Server) broadcast(msg any) {
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return
@@ -466,42 +876,85 @@ func (s *Server) broadcastMachineInfo() {
 	}
 }
 
+// broadcastUsageEntries sends new usage entries to every subscriber, limited
+// to each one's workdir scope.
 func (s *Server) broadcastUsageEntries(entries []UsageEntry) {
-	msg := UsageMessage{Type: "usage_entries", Entries: entries}
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return
-	}
-
-	s.mu.Lock()
-	subs := make([]*safeConn, 0, len(s.subscribers))
-	for conn := range s.subscribers {
-		subs = append(subs, conn)
-	}
-	s.mu.Unlock()
+	s.broadcastScoped(func(p *principal) any {
+		filtered := p.filterUsage(entries)
+		if len(filtered) == 0 {
+			return nil
+		}
+		return UsageMessage{Type: "usage_entries", Entries: filtered, Cursor: usageCursor(filtered)}
+	})
+}
 
-	for _, conn := range subs {
-		if err := conn.safeWrite(websocket.TextMessage, data); err != nil {
-			conn.Close()
+// sendUsageSince sends conn the usage entries p may see stamped since cursor
+// (all of them for ""), in batches of usageBatchSize.
+func (s *Server) sendUsageSince(conn *safeConn, p *principal, cursor string) {
+	var since time.Time
+	if cursor != "" {
+		t, err := time.Parse(time.RFC3339, cursor)
+		if err != nil {
+			s.sendError(conn, "usage cursor must be an RFC 3339 timestamp")
+			return
 		}
+		since = t.Add(-usageCursorSlack)
+	}
+	entries := p.filterUsage(s.usage.Collect(since))
+	s.costs.price(entries)
+	// Oldest first, so a client cut off mid-way holds a cursor that covers
+	// only what it received. Claude Code stamps entries in one ISO format,
+	// so they sort as strings.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp < entries[j].Timestamp
+	})
+	for len(entries) > 0 {
+		batch := entries[:min(len(entries), usageBatchSize)]
+		entries = entries[len(batch):]
+		s.sendJSON(conn, UsageMessage{Type: "usage_entries", Entries: batch, Cursor: usageCursor(batch)})
 	}
 }
 
+// broadcastSessions sends the session list to every subscriber, limited to
+// each one's workdir scope.
 func (s *Server) broadcastSessions(sessions []*SessionInfo) {
+	s.broadcastScoped(func(p *principal) any {
+		return ServerMessage{Type: "sessions", Sessions: p.filterSessions(sessions)}
+	})
+}
+
+// broadcastScoped sends each subscriber the message build returns for its
+// principal, skipping nil. Unscoped subscribers share one encoding.
+func (s *Server) broadcastScoped(build func(p *principal) any) {
 	s.mu.Lock()
-	subs := make([]*safeConn, 0, len(s.subscribers))
-	for conn := range s.subscribers {
-		subs = append(subs, conn)
+	subs := make(map[*safeConn]*principal, len(s.subscribers))
+	for conn, p := range s.subscribers {
+		subs[conn] = p
 	}
 	s.mu.Unlock()
 
-	msg := ServerMessage{Type: "sessions", Sessions: sessions}
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return
-	}
-
-	for _, conn := range subs {
+	var shared []byte
+	for conn, p := range subs {
+		if !s.auth.valid(p) {
+			conn.Close() // revoked or expired token
+			continue
+		}
+		var data []byte
+		if len(p.Workdirs) == 0 && shared != nil {
+			data = shared
+		} else {
+			msg := build(p)
+			if msg == nil {
+				continue
+			}
+			var err error
+			if data, err = json.Marshal(msg); err != nil {
+				continue
+			}
+			if len(p.Workdirs) == 0 {
+				shared = data
+			}
+		}
 		if err := conn.safeWrite(websocket.TextMessage, data); err != nil {
 			conn.Close()
 		}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Session operations shared by the WebSocket protocol and the REST API.
+// Errors returned here are safe to show to clients.
+
+var (
+	errWorkdirNotAllowed = errors.New("workdir not allowed")
+	errCreateFailed      = errors.New("failed to create session")
+	errKillFailed        = errors.New("failed to kill session")
+)
+
+// createSessionRequest holds the create_session options.
+type createSessionRequest struct {
+	Workdir                    string   `json:"workdir"`
+	Name                       string   `json:"name"`
+	Profile                    string   `json:"profile"`
+	Args                       []string `json:"args"`
+	DangerouslySkipPermissions bool     `json:"dangerously_skip_permissions"`
+	ResumeConversation         string   `json:"resume_conversation"`   // Claude session ID to resume
+	ContinueConversation       bool     `json:"continue_conversation"` // resume the workdir's latest
+	ForkConversation           bool     `json:"fork_conversation"`     // resume under a new session ID
+}
+
+// createSession starts a new tmux session for req and returns its ID and
+// display name. The workdir must be allowed by the config and within the
+// scope of p, whose name is recorded as the creator. A resumed conversation
+// runs in the workdir it was started in, which is the default workdir then.
+func (s *Server) createSession(req createSessionRequest, p *principal) (string, string, error) {
+	workdir := req.Workdir
+	if req.ResumeConversation != "" {
+		convWorkdir, err := s.conversationWorkdir(req.ResumeConversation)
+		if err != nil {
+			return "", "", err
+		}
+		if workdir == "" {
+			workdir = convWorkdir
+		} else if filepath.Clean(expandPath(workdir)) != filepath.Clean(convWorkdir) {
+			return "", "", errConversationWorkdir
+		}
+	}
+	if workdir == "" {
+		home, _ := os.UserHomeDir()
+		workdir = home
+	}
+	// Expand ~ to home directory (exec.Command doesn't do shell expansion)
+	if len(workdir) > 0 && workdir[0] == '~' {
+		home, _ := os.UserHomeDir()
+		workdir = home + workdir[1:]
+	}
+	if !s.isAllowedWorkdir(workdir) || !p.inScope(workdir) {
+		return "", "", errWorkdirNotAllowed
+	}
+	name := truncateUTF8(strings.TrimSpace(req.Name), maxDisplayNameRunes)
+	if name == "" {
+		name = "session"
+	}
+	profileName := req.Profile
+	if profileName == "" {
+		profileName = defaultProfile
+	}
+	profile, err := s.config.Profile(profileName)
+	if err != nil {
+		return "", "", err
+	}
+	resuming := req.ResumeConversation != "" || req.ContinueConversation
+	if resuming && !profile.isClaude() {
+		return "", "", errResumeNeedsClaude
+	}
+
+	sessionID := newTmuxSessionID(name)
+	var extra []string
+	if profile.isClaude() {
+		switch {
+		case req.ResumeConversation != "":
+			extra = append(extra, "--resume", req.ResumeConversation)
+		case req.ContinueConversation:
+			extra = append(extra, "--continue")
+		}
+		if resuming && req.ForkConversation {
+			extra = append(extra, "--fork-session")
+		}
+		if req.DangerouslySkipPermissions {
+			extra = append(extra, "--dangerously-skip-permissions")
+		}
+		if s.config.Hooks {
+			path, err := writeHookSettings(sessionID, s.config.HookSocket)
+			if err != nil {
+				// Not fatal: the poller falls back to screen scraping.
+				log.Printf("create_session: hooks: %v", err)
+			} else {
+				extra = append(extra, "--settings", path)
+			}
+		}
+	}
+	extra = append(extra, req.Args...)
+	var pipe string
+	if s.config.RecordSessions {
+		if pipe, err = recordCommand(expandPath(s.config.RecordingsDir), sessionID, name, workdir); err != nil {
+			// Not fatal: the session just isn't recorded.
+			log.Printf("create_session: recording: %v", err)
+		}
+	}
+	if err := createTmuxSession(sessionID, workdir, s.config.HistoryLimit, profile.commandLine(extra...), profile.Env, pipe); err != nil {
+		removeHookSettings(sessionID)
+		log.Printf("create_session error: %v", err)
+		return "", "", errCreateFailed
+	}
+	meta := SessionMeta{
+		Name:    name,
+		Workdir: workdir,
+		Profile: profileName,
+		Creator: p.Name,
+		Options: SessionOptions{
+			DangerouslySkipPermissions: req.DangerouslySkipPermissions,
+			Args:                       req.Args,
+			ResumeConversation:         req.ResumeConversation,
+			ContinueConversation:       req.ContinueConversation,
+			ForkConversation:           resuming && req.ForkConversation,
+		},
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	// The resumed conversation began before the session, so cost attribution
+	// by start time would miss it; link it up front. A fork gets a new ID,
+	// which hooks report.
+	if req.ResumeConversation != "" && !req.ForkConversation {
+		meta.ClaudeSessionIDs = []string{req.ResumeConversation}
+	}
+	s.poller.TrackSession(sessionID, meta)
+	return sessionID, name, nil
+}
+
+// killSession kills a tmux session and broadcasts the updated session list.
+func (s *Server) killSession(sessionID string) error {
+	log.Printf("kill_session: %q", sessionID)
+	if err := killTmuxSession(sessionID); err != nil {
+		log.Printf("kill_session error: %v", err)
+		return errKillFailed
+	}
+	log.Printf("kill_session: success")
+	s.poller.RemoveSession(sessionID)
+	removeHookSettings(sessionID)
+	s.broadcastSessions(s.poller.GetSessions())
+	return nil
+}
+
+var (
+	errSessionNotFound = errors.New("session not found")
+	errSessionNotIdle  = errors.New("session is not idle")
+)
+
+// sendPrompt delivers text to a session without attaching. With requireIdle
+// it refuses unless the poller currently sees the session as idle.
+func (s *Server) sendPrompt(sessionID, text string, submit, requireIdle bool) error {
+	info, ok := s.poller.GetSession(sessionID)
+	if !ok {
+		return errSessionNotFound
+	}
+	if requireIdle && info.State != StateIdle {
+		return errSessionNotIdle
+	}
+	if err := sendTmuxText(sessionID, text, submit); err != nil {
+		log.Printf("send_prompt %s: %v", sessionID, err)
+		return errors.New("failed to send prompt")
+	}
+	s.poller.AckBudget(sessionID)
+	return nil
+}
+
+// respondPrompt answers the choice dialog currently on screen. The pane is
+// re-read rather than trusting the last poll, so keys never land on a screen
+// that has moved on.
+func (s *Server) respondPrompt(sessionID string, option int) error {
+	pane, err := capturePaneVisible(sessionID)
+	if err != nil {
+		return errSessionNotFound
+	}
+	prompt := parsePermissionPrompt(pane)
+	if prompt == nil {
+		return errors.New("no prompt on screen")
+	}
+	keys, err := prompt.keysForOption(option)
+	if err != nil {
+		return err
+	}
+	if err := sendTmuxKeys(sessionID, keys...); err != nil {
+		log.Printf("respond_prompt %s: %v", sessionID, err)
+		return errors.New("failed to send keys")
+	}
+	s.poller.AckBudget(sessionID)
+	return nil
+}
+
+// Limits for user-supplied session metadata.
+const (
+	maxDisplayNameRunes = 200
+	maxNoteRunes        = 4000
+	maxTags             = 32
+	maxTagRunes         = 64
+)
+
+// updateSessionMeta applies fn to a session's metadata and broadcasts the
+// updated session list to every subscriber.
+func (s *Server) updateSessionMeta(sessionID string, fn func(*SessionMeta)) error {
+	if !s.poller.UpdateMeta(sessionID, fn) {
+		return errSessionNotFound
+	}
+	s.broadcastSessions(s.poller.GetSessions())
+	return nil
+}
+
+// normalizeTags trims, deduplicates and bounds a tag list, keeping order.
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, t := range tags {
+		t = truncateUTF8(strings.TrimSpace(t), maxTagRunes)
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		result = append(result, t)
+		if len(result) == maxTags {
+			break
+		}
+	}
+	return result
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	many := make([]string, maxTags+5)
+	for i := range many {
+		many[i] = fmt.Sprintf("t%d", i)
+	}
+	long := strings.Repeat("é", maxTagRunes+10)
+
+	tests := []struct {
+		name string
+		tags []string
+		want []string
+	}{
+		{"nil", nil, nil},
+		{"trimmed", []string{"  backend ", "\tapi\n"}, []string{"backend", "api"}},
+		{"empty dropped", []string{"", "  ", "x"}, []string{"x"}},
+		{"duplicates keep first", []string{"b", "a", "b", " a "}, []string{"b", "a"}},
+		{"long shortened by runes", []string{long}, []string{strings.Repeat("é", maxTagRunes)}},
+		{"capped", many, many[:maxTags]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := normalizeTags(tt.tags)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("normalizeTags(%q) = %q, want %q", tt.tags, got, tt.want)
+			}
+			for _, tag := range got {
+				if !utf8.ValidString(tag) {
+					t.Errorf("tag %q is not valid UTF-8", tag)
+				}
+			}
+		})
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
+	"sync/atomic"
 )
 
 type SessionState string
@@ -15,52 +17,138 @@ const (
 	StateDead           SessionState = "dead"
 )
 
-var needsAttentionPatterns []*regexp.Regexp
-var workingPatterns []*regexp.Regexp
-var pagerNeedsAttentionPatterns []*regexp.Regexp
-var startingPatterns []*regexp.Regexp
+// StateRule maps a regex over the bottom of the pane to a session state.
+// Rules are evaluated in order; the first match wins.
+type StateRule struct {
+	Name         string       `yaml:"name" json:"name"`
+	Pattern      string       `yaml:"pattern" json:"pattern"`
+	Lines        int          `yaml:"lines" json:"lines,omitempty"`                   // last N non-empty lines to match (default 8)
+	MaxPaneLines int          `yaml:"max_pane_lines" json:"max_pane_lines,omitempty"` // only match when the pane is shorter than this
+	State        SessionState `yaml:"state" json:"state"`
 
-func init() {
-	needsAttentionPatterns = []*regexp.Regexp{
-		regexp.MustCompile(`(?i)do you want to proceed`),
-		regexp.MustCompile(`\(y/?n\)`),
-		regexp.MustCompile(`(?i)^.{0,5}(allow|deny)\b`),
-		regexp.MustCompile(`(?i)accept.*reject|reject.*accept`),
-		regexp.MustCompile(`(?i)press.*to continue`),
-		regexp.MustCompile(`(?i)would you like`),
-		regexp.MustCompile(`(?i)^error:|^ERROR`),
-		regexp.MustCompile(`(?i)rate.?limit|exceeded`),
-		regexp.MustCompile(`(?i)permission.*denied`),
-		regexp.MustCompile(`(?i)do you want to`),
-		regexp.MustCompile(`Enter to select`),
-	}
+	re *regexp.Regexp
+}
+
+// defaultRuleLines is the line window used when a rule doesn't set one.
+const defaultRuleLines = 8
+
+// defaultStateRules are the built-in rules for Claude Code's TUI, used when
+// the config doesn't provide its own.
+var defaultStateRules = []StateRule{
+	// Pager that needs user action (press q)
+	{Name: "pager-press-q", Pattern: `(?i)press q`, State: StateNeedsAttention},
+
+	{Name: "proceed-prompt", Pattern: `(?i)do you want to proceed`, State: StateNeedsAttention},
+	{Name: "yes-no", Pattern: `\(y/?n\)`, State: StateNeedsAttention},
+	{Name: "allow-deny", Pattern: `(?i)^.{0,5}(allow|deny)\b`, State: StateNeedsAttention},
+	{Name: "accept-reject", Pattern: `(?i)accept.*reject|reject.*accept`, State: StateNeedsAttention},
+	{Name: "press-to-continue", Pattern: `(?i)press.*to continue`, State: StateNeedsAttention},
+	{Name: "would-you-like", Pattern: `(?i)would you like`, State: StateNeedsAttention},
+	{Name: "error", Pattern: `(?i)^error:|^ERROR`, State: StateNeedsAttention},
+	{Name: "rate-limit", Pattern: `(?i)rate.?limit|exceeded`, State: StateNeedsAttention},
+	{Name: "permission-denied", Pattern: `(?i)permission.*denied`, State: StateNeedsAttention},
+	{Name: "do-you-want", Pattern: `(?i)do you want to`, State: StateNeedsAttention},
+	{Name: "enter-to-select", Pattern: `Enter to select`, State: StateNeedsAttention},
+
+	{Name: "spinner", Pattern: `[⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏]`, State: StateWorking},
+	{Name: "thinking", Pattern: `(?i)^\s*[⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏]?\s*(thinking|reasoning)`, State: StateWorking},
+	{Name: "spinner-activity", Pattern: `(?i)^\s*[⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏]\s*(reading|writing|searching|running|executing)`, State: StateWorking},
+	{Name: "tool-line", Pattern: `(?i)^(bash|edit|multiedit|read|write|glob|grep|todoread|todowrite)\s*:`, State: StateWorking},
+	{Name: "using-tool", Pattern: `(?i)^\s*tool\s*:|using tool`, State: StateWorking},
+	{Name: "esc-to-interrupt", Pattern: `(?i)esc to interrupt`, State: StateWorking},
+
+	// Pager in working state (j/k to scroll)
+	{Name: "pager-scroll", Pattern: `(?i)j/k.*scroll|q.*quit`, State: StateWorking},
+
+	// Startup screen — only while the pane has very little content
+	{Name: "startup-banner", Pattern: `(?i)claude code`, MaxPaneLines: 20, State: StateStarting},
+	{Name: "startup-loading", Pattern: `(?i)starting|loading|initializing`, MaxPaneLines: 20, State: StateStarting},
+	{Name: "startup-box", Pattern: `╭─`, MaxPaneLines: 20, State: StateStarting},
+}
 
-	workingPatterns = []*regexp.Regexp{
-		regexp.MustCompile(`[⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏]`),
-		regexp.MustCompile(`(?i)^\s*[⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏]?\s*(thinking|reasoning)`),
-		regexp.MustCompile(`(?i)^\s*[⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏]\s*(reading|writing|searching|running|executing)`),
-		regexp.MustCompile(`(?i)^(bash|edit|multiedit|read|write|glob|grep|todoread|todowrite)\s*:`),
-		regexp.MustCompile(`(?i)^\s*tool\s*:|using tool`),
-		regexp.MustCompile(`(?i)esc to interrupt`),
+// ruleSet is an ordered, compiled list of state rules.
+type ruleSet struct {
+	rules []StateRule
+}
+
+// compileRules validates and compiles rules into a ruleSet.
+func compileRules(rules []StateRule) (*ruleSet, error) {
+	compiled := make([]StateRule, 0, len(rules))
+	for i, r := range rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		switch r.State {
+		case StateIdle, StateWorking, StateNeedsAttention, StateStarting, StateDead:
+		default:
+			return nil, fmt.Errorf("rule %q: unknown state %q", r.Name, r.State)
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+		if r.Lines <= 0 {
+			r.Lines = defaultRuleLines
+		}
+		r.re = re
+		compiled = append(compiled, r)
 	}
+	return &ruleSet{rules: compiled}, nil
+}
+
+// ruleSets maps detector names (as referenced by launch profiles) to rules.
+type ruleSets map[string]*ruleSet
 
-	pagerNeedsAttentionPatterns = []*regexp.Regexp{
-		regexp.MustCompile(`(?i)press q`),
+// defaultDetector is the rule set for Claude Code. It is also used for
+// sessions whose detector is unknown.
+const defaultDetector = "claude"
+
+// builtinRuleSets returns the detectors available without any config. The
+// shell detector has no rules, so a shell with output is simply idle.
+func builtinRuleSets() ruleSets {
+	claude, err := compileRules(defaultStateRules)
+	if err != nil {
+		panic(err)
+	}
+	return ruleSets{
+		defaultDetector: claude,
+		"shell":         {},
 	}
+}
+
+var activeRules atomic.Pointer[ruleSets]
 
-	startingPatterns = []*regexp.Regexp{
-		regexp.MustCompile(`(?i)claude code`),
-		regexp.MustCompile(`(?i)starting|loading|initializing`),
-		regexp.MustCompile(`╭─`),
+func init() {
+	setStateRules(builtinRuleSets())
+}
+
+// setStateRules swaps the rule sets used by detectState.
+func setStateRules(sets ruleSets) {
+	activeRules.Store(&sets)
+}
+
+// rulesFor returns the rule set named detector, falling back to the default.
+func rulesFor(detector string) *ruleSet {
+	sets := *activeRules.Load()
+	if rs, ok := sets[detector]; ok {
+		return rs
 	}
+	return sets[defaultDetector]
 }
 
-func detectState(paneText string) SessionState {
+func detectState(detector, paneText string) SessionState {
+	state, _ := rulesFor(detector).detect(paneText)
+	return state
+}
+
+// detect returns the state for paneText and the rule that produced it, or nil
+// when no rule fired (empty pane or default idle).
+func (rs *ruleSet) detect(paneText string) (SessionState, *StateRule) {
 	lines := strings.Split(paneText, "\n")
 
-	// Get last 8 non-empty lines for analysis
+	// Collect non-empty lines bottom-up; each rule looks at its own window.
 	var lastLines []string
-	for i := len(lines) - 1; i >= 0 && len(lastLines) < 8; i-- {
+	for i := len(lines) - 1; i >= 0; i-- {
 		trimmed := strings.TrimSpace(lines[i])
 		if trimmed != "" {
 			lastLines = append(lastLines, trimmed)
@@ -68,47 +156,26 @@ func detectState(paneText string) SessionState {
 	}
 
 	if len(lastLines) == 0 {
-		return StateStarting
+		return StateStarting, nil
 	}
 
-	combined := strings.Join(lastLines, "\n")
-
-	// Check pager that needs user action (press q)
-	for _, pat := range pagerNeedsAttentionPatterns {
-		if pat.MatchString(combined) {
-			return StateNeedsAttention
+	windows := make(map[int]string)
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		if r.MaxPaneLines > 0 && len(lines) >= r.MaxPaneLines {
+			continue
 		}
-	}
-
-	// Check needs attention patterns
-	for _, pat := range needsAttentionPatterns {
-		if pat.MatchString(combined) {
-			return StateNeedsAttention
-		}
-	}
-
-	// Check working patterns
-	for _, pat := range workingPatterns {
-		if pat.MatchString(combined) {
-			return StateWorking
+		combined, ok := windows[r.Lines]
+		if !ok {
+			n := min(r.Lines, len(lastLines))
+			combined = strings.Join(lastLines[:n], "\n")
+			windows[r.Lines] = combined
 		}
-	}
-
-	// Check pager in working state (j/k to scroll)
-	if regexp.MustCompile(`(?i)j/k.*scroll|q.*quit`).MatchString(combined) {
-		return StateWorking
-	}
-
-	// Check if starting
-	// Only if we see very few lines of content overall (startup screen)
-	if len(lines) < 20 {
-		for _, pat := range startingPatterns {
-			if pat.MatchString(combined) {
-				return StateStarting
-			}
+		if r.re.MatchString(combined) {
+			return r.State, r
 		}
 	}
 
 	// Default: idle
-	return StateIdle
+	return StateIdle, nil
 }
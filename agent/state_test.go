@@ -0,0 +1,122 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// legacyDetectState is detectState as it was before state rules became
+// configurable: fixed pattern groups checked in a fixed order.
+func legacyDetectState(paneText string) SessionState {
+	lines := strings.Split(paneText, "\n")
+	var lastLines []string
+	for i := len(lines) - 1; i >= 0 && len(lastLines) < 8; i-- {
+		if trimmed := strings.TrimSpace(lines[i]); trimmed != "" {
+			lastLines = append(lastLines, trimmed)
+		}
+	}
+	if len(lastLines) == 0 {
+		return StateStarting
+	}
+	combined := strings.Join(lastLines, "\n")
+
+	matchAny := func(patterns ...string) bool {
+		for _, p := range patterns {
+			if regexp.MustCompile(p).MatchString(combined) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case matchAny(`(?i)press q`):
+		return StateNeedsAttention
+	case matchAny(`(?i)do you want to proceed`, `\(y/?n\)`, `(?i)^.{0,5}(allow|deny)\b`,
+		`(?i)accept.*reject|reject.*accept`, `(?i)press.*to continue`, `(?i)would you like`,
+		`(?i)^error:|^ERROR`, `(?i)rate.?limit|exceeded`, `(?i)permission.*denied`,
+		`(?i)do you want to`, `Enter to select`):
+		return StateNeedsAttention
+	case matchAny(`[⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏]`, `(?i)^\s*[⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏]?\s*(thinking|reasoning)`,
+		`(?i)^\s*[⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏]\s*(reading|writing|searching|running|executing)`,
+		`(?i)^(bash|edit|multiedit|read|write|glob|grep|todoread|todowrite)\s*:`,
+		`(?i)^\s*tool\s*:|using tool`, `(?i)esc to interrupt`):
+		return StateWorking
+	case matchAny(`(?i)j/k.*scroll|q.*quit`):
+		return StateWorking
+	case len(lines) < 20 && matchAny(`(?i)claude code`, `(?i)starting|loading|initializing`, `╭─`):
+		return StateStarting
+	}
+	return StateIdle
+}
+
+func TestDefaultRulesMatchLegacyDetection(t *testing.T) {
+	padding := strings.Repeat("output line\n", 30)
+	tests := []struct {
+		name  string
+		pane  string
+		state SessionState
+		rule  string // "" when no rule fires
+	}{
+		{"empty", "\n\n  \n", StateStarting, ""},
+		{"idle prompt", padding + "> \n", StateIdle, ""},
+		{"pager press q", padding + "(END) press q to exit", StateNeedsAttention, "pager-press-q"},
+		{"proceed", padding + "Do you want to proceed?\n❯ 1. Yes\n  2. No", StateNeedsAttention, "proceed-prompt"},
+		{"yes no", padding + "Overwrite? (y/n)", StateNeedsAttention, "yes-no"},
+		{"allow", padding + "  Allow once", StateNeedsAttention, "allow-deny"},
+		{"error", padding + "Error: something broke", StateNeedsAttention, "error"},
+		{"rate limit", padding + "Rate limit reached", StateNeedsAttention, "rate-limit"},
+		{"attention beats spinner", padding + "⠋ Running\nDo you want to proceed?", StateNeedsAttention, "proceed-prompt"},
+		{"spinner", padding + "⠙ Compiling…", StateWorking, "spinner"},
+		{"thinking", padding + "Thinking about it", StateWorking, "thinking"},
+		{"tool line", padding + "Bash: go test ./...", StateWorking, "tool-line"},
+		{"esc to interrupt", padding + "· Pondering… (esc to interrupt)", StateWorking, "esc-to-interrupt"},
+		{"pager scroll", padding + "j/k to scroll", StateWorking, "pager-scroll"},
+		{"startup banner", "╭──────╮\n│ Welcome to Claude Code │\n╰──────╯", StateStarting, "startup-banner"},
+		{"banner on a long pane", padding + "Welcome to Claude Code", StateIdle, ""},
+		{"outside the window", "Do you want to proceed?\n" + padding, StateIdle, ""},
+	}
+
+	rs := rulesFor(defaultDetector)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, rule := rs.detect(tt.pane)
+			if state != tt.state {
+				t.Errorf("detect = %s, want %s", state, tt.state)
+			}
+			if legacy := legacyDetectState(tt.pane); state != legacy {
+				t.Errorf("detect = %s, legacy detection = %s", state, legacy)
+			}
+			name := ""
+			if rule != nil {
+				name = rule.Name
+			}
+			if name != tt.rule {
+				t.Errorf("rule = %q, want %q", name, tt.rule)
+			}
+		})
+	}
+}
+
+func TestCompileRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []StateRule
+		wantErr bool
+	}{
+		{"valid", []StateRule{{Pattern: `x`, State: StateWorking}}, false},
+		{"unknown state", []StateRule{{Pattern: `x`, State: "busy"}}, true},
+		{"bad pattern", []StateRule{{Pattern: `(`, State: StateIdle}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, err := compileRules(tt.rules)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (rs.rules[0].Name != "rule-1" || rs.rules[0].Lines != defaultRuleLines) {
+				t.Errorf("defaults not applied: %+v", rs.rules[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SessionMeta is what the agent knows about a session beyond what tmux
+// reports. It is persisted so it survives agent restarts and self-updates.
+type SessionMeta struct {
+	Name      string         `json:"name"`    // display name
+	Workdir   string         `json:"workdir"` // workdir at creation, not the pane's current one
+	Profile   string         `json:"profile,omitempty"`
+	Creator   string         `json:"creator,omitempty"`
+	Tags      []string       `json:"tags,omitempty"`
+	Note      string         `json:"note,omitempty"`
+	Options   SessionOptions `json:"options"`
+	CreatedAt int64          `json:"created_at"` // unix millis
+
+	// Claude conversations known to run in it, oldest first: the one it
+	// resumed and those its hooks reported.
+	ClaudeSessionIDs []string `json:"claude_session_ids,omitempty"`
+}
+
+// SessionOptions are the create_session options a session was started with.
+type SessionOptions struct {
+	DangerouslySkipPermissions bool     `json:"dangerously_skip_permissions,omitempty"`
+	Args                       []string `json:"args,omitempty"`
+	ResumeConversation         string   `json:"resume_conversation,omitempty"`
+	ContinueConversation       bool     `json:"continue_conversation,omitempty"`
+	ForkConversation           bool     `json:"fork_conversation,omitempty"`
+}
+
+func defaultSessionStorePath() string {
+	return filepath.Join(agentDataDir(), "sessions.json")
+}
+
+// sessionStore is a small JSON file of SessionMeta keyed by tmux session ID.
+// Every mutation rewrites the file; there are at most a few dozen sessions.
+type sessionStore struct {
+	mu       sync.Mutex
+	path     string
+	sessions map[string]*SessionMeta
+}
+
+// loadSessionStore reads the store at path. A missing file is an empty store.
+func loadSessionStore(path string) (*sessionStore, error) {
+	st := &sessionStore{path: path, sessions: make(map[string]*SessionMeta)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return st, fmt.Errorf("reading session store: %w", err)
+	}
+	if err := json.Unmarshal(data, &st.sessions); err != nil {
+		st.sessions = make(map[string]*SessionMeta)
+		return st, fmt.Errorf("parsing session store: %w", err)
+	}
+	if st.sessions == nil {
+		st.sessions = make(map[string]*SessionMeta)
+	}
+	return st, nil
+}
+
+// Get returns a copy of the metadata for id.
+func (st *sessionStore) Get(id string) (SessionMeta, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	m, ok := st.sessions[id]
+	if !ok {
+		return SessionMeta{}, false
+	}
+	return *m, true
+}
+
+// Put stores meta for id and persists the store.
+func (st *sessionStore) Put(id string, meta SessionMeta) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sessions[id] = &meta
+	st.save()
+}
+
+// Update applies fn to the metadata for id and persists the store. It
+// reports false if id is unknown.
+func (st *sessionStore) Update(id string, fn func(*SessionMeta)) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	m, ok := st.sessions[id]
+	if !ok {
+		return false
+	}
+	fn(m)
+	st.save()
+	return true
+}
+
+// Delete forgets id and persists the store.
+func (st *sessionStore) Delete(id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.sessions[id]; !ok {
+		return
+	}
+	delete(st.sessions, id)
+	st.save()
+}
+
+// Reconcile drops sessions that are no longer alive in tmux and returns their
+// IDs. Entries created at or after notBefore (unix millis) are kept, since
+// they may have been added after the caller listed tmux sessions.
+func (st *sessionStore) Reconcile(alive map[string]bool, notBefore int64) []string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var removed []string
+	for id, m := range st.sessions {
+		if !alive[id] && m.CreatedAt < notBefore {
+			delete(st.sessions, id)
+			removed = append(removed, id)
+		}
+	}
+	if len(removed) > 0 {
+		st.save()
+	}
+	return removed
+}
+
+// save writes the store atomically. Callers must hold st.mu.
+func (st *sessionStore) save() {
+	data, err := json.MarshalIndent(st.sessions, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(st.path), 0700); err != nil {
+		log.Printf("session store: %v", err)
+		return
+	}
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("session store: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, st.path); err != nil {
+		log.Printf("session store: %v", err)
+	}
+}
@@ -87,6 +87,18 @@ func (t *TerminalSession) Resize(cols, rows uint16) error {
 	return pty.Setsize(f, &pty.Winsize{Cols: cols, Rows: rows})
 }
 
+// Refresh asks tmux to redraw the whole screen of this client.
+func (t *TerminalSession) Refresh() error {
+	t.mu.Lock()
+	cmd := t.cmd
+	t.mu.Unlock()
+
+	if cmd == nil || cmd.Process == nil {
+		return fmt.Errorf("not attached")
+	}
+	return refreshTmuxClient(cmd.Process.Pid)
+}
+
 func (t *TerminalSession) Detach() error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
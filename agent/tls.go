@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// selfSignedValidity is how long an auto-generated certificate is valid.
+// Clients pin its fingerprint, so a long lifetime avoids re-pinning.
+const selfSignedValidity = 5 * 365 * 24 * time.Hour
+
+func defaultTLSDir() string {
+	return filepath.Join(agentDataDir(), "tls")
+}
+
+// buildTLSConfig returns the listener TLS config, or nil when TLS is off.
+// With tls_auto and no tls_cert, a self-signed certificate for bindAddr is
+// generated once and reused on later starts.
+func buildTLSConfig(cfg *Config, bindAddr string) (*tls.Config, error) {
+	certFile, keyFile := expandPath(cfg.TLSCert), expandPath(cfg.TLSKey)
+	if certFile == "" && cfg.TLSAuto {
+		certFile = filepath.Join(defaultTLSDir(), "agent.crt")
+		keyFile = filepath.Join(defaultTLSDir(), "agent.key")
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			if err := generateSelfSigned(certFile, keyFile, bindAddr); err != nil {
+				return nil, fmt.Errorf("generating self-signed certificate: %w", err)
+			}
+		}
+	}
+	if certFile == "" {
+		if cfg.ClientCA != "" {
+			return nil, fmt.Errorf("client_ca requires tls_cert/tls_key or tls_auto")
+		}
+		return nil, nil
+	}
+	if keyFile == "" {
+		return nil, fmt.Errorf("tls_cert requires tls_key")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.ClientCA != "" {
+		caPEM, err := os.ReadFile(expandPath(cfg.ClientCA))
+		if err != nil {
+			return nil, fmt.Errorf("reading client_ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("client_ca: no certificates found")
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsCfg, nil
+}
+
+// certFingerprint returns the SHA-256 fingerprint of a certificate in the
+// colon-separated form browsers and openssl print.
+func certFingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	hexSum := strings.ToUpper(hex.EncodeToString(sum[:]))
+	var parts []string
+	for i := 0; i < len(hexSum); i += 2 {
+		parts = append(parts, hexSum[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
+
+// generateSelfSigned writes an ECDSA P-256 certificate valid for the host
+// name, bindAddr and loopback, plus its key, to certFile and keyFile.
+func generateSelfSigned(certFile, keyFile, bindAddr string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "ccdash-agent " + hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" {
+		tmpl.DNSNames = append(tmpl.DNSNames, hostname)
+	}
+	if ip := net.ParseIP(bindAddr); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+		tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certFile), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
@@ -16,6 +16,15 @@ type TmuxSession struct {
 	Attached  bool   `json:"attached"`
 	Width     int    `json:"width"`
 	Height    int    `json:"height"`
+	PanePID   int    `json:"pane_pid"` // the active pane's process
+}
+
+// tmuxOutput runs a tmux command, timing it for /metrics.
+func tmuxOutput(cmd *exec.Cmd) ([]byte, error) {
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	tmuxLatency.observe(cmd.Args[1], time.Since(start))
+	return out, err
 }
 
 func tmuxAvailable() bool {
@@ -23,18 +32,28 @@ func tmuxAvailable() bool {
 	return err == nil
 }
 
-func createTmuxSession(name, workdir string, historyLimit int, dangerouslySkipPermissions bool) (string, error) {
-	sessionID := fmt.Sprintf("cc-%d-%s", time.Now().UnixMilli(), sanitizeName(name))
+func newTmuxSessionID(name string) string {
+	return fmt.Sprintf("cc-%d-%s", time.Now().UnixMilli(), sanitizeName(name))
+}
 
+// createTmuxSession starts sessionID detached in workdir with env set and
+// types commandLine into its shell; an empty commandLine leaves a plain
+// shell. A non-empty pipeCommand receives all pane output from before the
+// command starts (see tmux pipe-pane).
+func createTmuxSession(sessionID, workdir string, historyLimit int, commandLine string, env map[string]string, pipeCommand string) error {
 	// Create tmux session
-	cmd := exec.Command("tmux", "new-session", "-d",
+	args := []string{"new-session", "-d",
 		"-s", sessionID,
 		"-c", workdir,
 		"-x", "200",
 		"-y", "50",
-	)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return "", fmt.Errorf("tmux new-session: %s: %w", string(out), err)
+	}
+	for k, v := range env {
+		args = append(args, "-e", k+"="+v)
+	}
+	cmd := exec.Command("tmux", args...)
+	if out, err := tmuxOutput(cmd); err != nil {
+		return fmt.Errorf("tmux new-session: %s: %w", string(out), err)
 	}
 
 	// Make tmux invisible and behave like a plain terminal.
@@ -56,29 +75,34 @@ func createTmuxSession(name, workdir string, historyLimit int, dangerouslySkipPe
 	}
 	for k, v := range opts {
 		cmd = exec.Command("tmux", "set-option", "-t", sessionID, k, v)
-		if out, err := cmd.CombinedOutput(); err != nil {
+		if out, err := tmuxOutput(cmd); err != nil {
 			// Non-fatal: older tmux may not support all options
 			log.Printf("tmux set-option %s: %s", k, strings.TrimSpace(string(out)))
 		}
 	}
 
-	// Start Claude Code inside
-	claudeCmd := "claude"
-	if dangerouslySkipPermissions {
-		claudeCmd = "claude --dangerously-skip-permissions"
-	}
-	cmd = exec.Command("tmux", "send-keys", "-t", sessionID, claudeCmd, "Enter")
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return "", fmt.Errorf("tmux send-keys: %s: %w", string(out), err)
+	if pipeCommand != "" {
+		cmd = exec.Command("tmux", "pipe-pane", "-O", "-t", sessionID, pipeCommand)
+		if out, err := tmuxOutput(cmd); err != nil {
+			// Non-fatal: the session just isn't recorded.
+			log.Printf("tmux pipe-pane: %s", strings.TrimSpace(string(out)))
+		}
 	}
 
-	return sessionID, nil
+	// Start the profile's command inside
+	if commandLine == "" {
+		return nil
+	}
+	if err := pasteTmuxText(sessionID, commandLine, false); err != nil {
+		return err
+	}
+	return sendTmuxKeys(sessionID, "Enter")
 }
 
 func listTmuxSessions() ([]TmuxSession, error) {
 	cmd := exec.Command("tmux", "list-sessions", "-F",
-		"#{session_id}:#{session_name}:#{session_created}:#{session_windows}:#{session_attached}:#{session_width}:#{session_height}")
-	out, err := cmd.CombinedOutput()
+		"#{session_id}:#{session_name}:#{session_created}:#{session_windows}:#{session_attached}:#{session_width}:#{session_height}:#{pane_pid}")
+	out, err := tmuxOutput(cmd)
 	if err != nil {
 		outStr := string(out)
 		if strings.Contains(outStr, "no server running") ||
@@ -94,8 +118,8 @@ func listTmuxSessions() ([]TmuxSession, error) {
 		if line == "" {
 			continue
 		}
-		parts := strings.SplitN(line, ":", 7)
-		if len(parts) < 7 {
+		parts := strings.SplitN(line, ":", 8)
+		if len(parts) < 8 {
 			continue
 		}
 
@@ -112,6 +136,8 @@ func listTmuxSessions() ([]TmuxSession, error) {
 		var width, height int
 		fmt.Sscanf(parts[5], "%d", &width)
 		fmt.Sscanf(parts[6], "%d", &height)
+		var panePID int
+		fmt.Sscanf(parts[7], "%d", &panePID)
 
 		sessions = append(sessions, TmuxSession{
 			ID:       parts[0],
@@ -121,6 +147,7 @@ func listTmuxSessions() ([]TmuxSession, error) {
 			Attached: parts[4] == "1",
 			Width:    width,
 			Height:   height,
+			PanePID:  panePID,
 		})
 	}
 	return sessions, nil
@@ -128,7 +155,7 @@ func listTmuxSessions() ([]TmuxSession, error) {
 
 func killTmuxSession(sessionID string) error {
 	cmd := exec.Command("tmux", "kill-session", "-t", sessionID)
-	if out, err := cmd.CombinedOutput(); err != nil {
+	if out, err := tmuxOutput(cmd); err != nil {
 		return fmt.Errorf("tmux kill-session: %s: %w", string(out), err)
 	}
 	return nil
@@ -136,16 +163,46 @@ func killTmuxSession(sessionID string) error {
 
 func getPaneWorkdir(sessionID string) (string, error) {
 	cmd := exec.Command("tmux", "display-message", "-t", sessionID, "-p", "#{pane_current_path}")
-	out, err := cmd.CombinedOutput()
+	out, err := tmuxOutput(cmd)
 	if err != nil {
 		return "", fmt.Errorf("tmux display-message: %s: %w", string(out), err)
 	}
 	return strings.TrimSpace(string(out)), nil
 }
 
+// paneSize returns the current width and height of a session's pane.
+func paneSize(sessionID string) (int, int, error) {
+	cmd := exec.Command("tmux", "display-message", "-t", sessionID, "-p", "#{pane_width} #{pane_height}")
+	out, err := tmuxOutput(cmd)
+	if err != nil {
+		return 0, 0, fmt.Errorf("tmux display-message: %s: %w", string(out), err)
+	}
+	var w, h int
+	if _, err := fmt.Sscan(string(out), &w, &h); err != nil {
+		return 0, 0, fmt.Errorf("parsing pane size %q: %w", out, err)
+	}
+	return w, h, nil
+}
+
 func capturePaneVisible(sessionID string) (string, error) {
 	cmd := exec.Command("tmux", "capture-pane", "-t", sessionID, "-p", "-J")
-	out, err := cmd.CombinedOutput()
+	out, err := tmuxOutput(cmd)
+	if err != nil {
+		return "", fmt.Errorf("tmux capture-pane: %s: %w", string(out), err)
+	}
+	return string(out), nil
+}
+
+// capturePaneHistory returns up to lines of scrollback above the visible
+// screen. With escapes, colors and attributes are kept for terminal replay.
+func capturePaneHistory(sessionID string, lines int, escapes bool) (string, error) {
+	args := []string{"capture-pane", "-t", sessionID, "-p", "-J",
+		"-S", fmt.Sprintf("-%d", lines), "-E", "-1"}
+	if escapes {
+		args = append(args, "-e")
+	}
+	cmd := exec.Command("tmux", args...)
+	out, err := tmuxOutput(cmd)
 	if err != nil {
 		return "", fmt.Errorf("tmux capture-pane: %s: %w", string(out), err)
 	}
@@ -168,3 +225,74 @@ func sanitizeName(name string) string {
 	}
 	return s
 }
+
+// sendTmuxText types text into a session as if pasted, optionally followed by
+// Enter. Text goes through a paste buffer with bracketed paste, so embedded
+// newlines don't submit early.
+func sendTmuxText(sessionID, text string, submit bool) error {
+	if text != "" {
+		if err := pasteTmuxText(sessionID, text, true); err != nil {
+			return err
+		}
+	}
+
+	if !submit {
+		return nil
+	}
+	// Give the app a moment to process the paste before Enter arrives,
+	// otherwise it may be swallowed as part of the pasted input.
+	time.Sleep(100 * time.Millisecond)
+	return sendTmuxKeys(sessionID, "Enter")
+}
+
+// pasteTmuxText pastes text into a session through a paste buffer, so tmux
+// never parses it: send-keys would take a leading "-" for a flag and drop a
+// trailing ";", even with -l. bracketed wraps it in bracketed paste if the
+// app asked for that.
+func pasteTmuxText(sessionID, text string, bracketed bool) error {
+	buffer := "ccdash-" + sessionID
+	cmd := exec.Command("tmux", "load-buffer", "-b", buffer, "-")
+	cmd.Stdin = strings.NewReader(text)
+	if out, err := tmuxOutput(cmd); err != nil {
+		return fmt.Errorf("tmux load-buffer: %s: %w", string(out), err)
+	}
+	args := []string{"paste-buffer", "-b", buffer, "-t", sessionID, "-d"}
+	if bracketed {
+		args = append(args, "-p")
+	}
+	if out, err := tmuxOutput(exec.Command("tmux", args...)); err != nil {
+		return fmt.Errorf("tmux paste-buffer: %s: %w", string(out), err)
+	}
+	return nil
+}
+
+// sendTmuxKeys sends named keys (e.g. "Down", "Enter") to a session.
+func sendTmuxKeys(sessionID string, keys ...string) error {
+	args := append([]string{"send-keys", "-t", sessionID}, keys...)
+	cmd := exec.Command("tmux", args...)
+	if out, err := tmuxOutput(cmd); err != nil {
+		return fmt.Errorf("tmux send-keys: %s: %w", string(out), err)
+	}
+	return nil
+}
+
+// refreshTmuxClient forces a full redraw of the tmux client started with pid.
+func refreshTmuxClient(pid int) error {
+	cmd := exec.Command("tmux", "list-clients", "-F", "#{client_pid}:#{client_tty}")
+	out, err := tmuxOutput(cmd)
+	if err != nil {
+		return fmt.Errorf("tmux list-clients: %s: %w", string(out), err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] != fmt.Sprintf("%d", pid) {
+			continue
+		}
+		cmd = exec.Command("tmux", "refresh-client", "-t", parts[1])
+		if out, err := tmuxOutput(cmd); err != nil {
+			return fmt.Errorf("tmux refresh-client: %s: %w", string(out), err)
+		}
+		return nil
+	}
+	return fmt.Errorf("tmux client for pid %d not found", pid)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// TranscriptEvent is one step of a Claude conversation, read from its JSONL
+// transcript: a prompt, a tool call, a tool result or an error. Prompt and
+// tool content is left out; only error messages are kept, shortened.
+type TranscriptEvent struct {
+	Kind        string   `json:"kind"`       // prompt, tool_use, tool_result or error
+	SessionID   string   `json:"session_id"` // Claude conversation ID
+	UUID        string   `json:"uuid"`
+	Timestamp   string   `json:"timestamp"`
+	Workdir     string   `json:"workdir"`
+	Tool        string   `json:"tool,omitempty"`
+	ToolUseID   string   `json:"tool_use_id,omitempty"`
+	Files       []string `json:"files,omitempty"`       // tool_use: paths in the tool input
+	DurationMs  int64    `json:"duration_ms,omitempty"` // tool_result: time since the tool_use
+	IsError     bool     `json:"is_error,omitempty"`
+	Error       string   `json:"error,omitempty"` // first line, shortened
+	PromptChars int      `json:"prompt_chars,omitempty"`
+}
+
+// TranscriptMessage carries transcript events, live or answering get_events.
+type TranscriptMessage struct {
+	Type   string            `json:"type"`
+	Events []TranscriptEvent `json:"events"`
+}
+
+const (
+	maxEventError      = 200  // runes of an error message kept
+	maxPendingToolUses = 1000 // tool_uses awaiting results before giving up on them
+	maxTranscriptKept  = 5000 // events kept in memory for get_events
+)
+
+// transcriptLine is the part of a JSONL transcript line events and
+// conversation summaries come from.
+type transcriptLine struct {
+	Type       string          `json:"type"`
+	Level      string          `json:"level"`   // system lines
+	Content    json.RawMessage `json:"content"` // system lines
+	SessionID  string          `json:"sessionId"`
+	UUID       string          `json:"uuid"`
+	Timestamp  string          `json:"timestamp"`
+	IsMeta     bool            `json:"isMeta"`
+	IsAPIError bool            `json:"isApiErrorMessage"`
+	Summary    string          `json:"summary"` // summary lines
+	Message    *struct {
+		Content json.RawMessage `json:"content"`
+	} `json:"message"`
+}
+
+// transcriptBlock is one block of a message's content.
+type transcriptBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text"`
+	ID        string          `json:"id"`   // tool_use
+	Name      string          `json:"name"` // tool_use
+	Input     map[string]any  `json:"input"`
+	ToolUseID string          `json:"tool_use_id"` // tool_result
+	IsError   bool            `json:"is_error"`
+	Content   json.RawMessage `json:"content"` // tool_result: string or blocks
+}
+
+// contentBlocks decodes message content, which is either a string or a list
+// of blocks.
+func contentBlocks(raw json.RawMessage) []transcriptBlock {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return []transcriptBlock{{Type: "text", Text: text}}
+	}
+	var blocks []transcriptBlock
+	json.Unmarshal(raw, &blocks)
+	return blocks
+}
+
+func contentText(raw json.RawMessage) string {
+	var parts []string
+	for _, b := range contentBlocks(raw) {
+		if b.Type == "text" {
+			parts = append(parts, b.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// shortError is the first non-empty line of msg, cut to maxEventError runes.
+func shortError(msg string) string {
+	for _, line := range strings.Split(msg, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if utf8.RuneCountInString(line) > maxEventError {
+			line = string([]rune(line)[:maxEventError]) + "…"
+		}
+		return line
+	}
+	return ""
+}
+
+// toolFiles returns the paths a tool input names.
+func toolFiles(input map[string]any) []string {
+	var files []string
+	for _, key := range []string{"file_path", "notebook_path", "path"} {
+		if p, ok := input[key].(string); ok && p != "" {
+			files = append(files, p)
+		}
+	}
+	return files
+}
+
+type pendingToolUse struct {
+	tool string
+	at   time.Time
+}
+
+// transcriptParser turns transcript lines into events, pairing tool results
+// with their calls. It is only used from the scan goroutine.
+type transcriptParser struct {
+	pending map[string]pendingToolUse // tool_use ID -> call
+}
+
+func newTranscriptParser() *transcriptParser {
+	return &transcriptParser{pending: make(map[string]pendingToolUse)}
+}
+
+func (t *transcriptParser) parse(line []byte, workdir string) []TranscriptEvent {
+	var tl transcriptLine
+	if err := json.Unmarshal(line, &tl); err != nil {
+		return nil
+	}
+	base := TranscriptEvent{SessionID: tl.SessionID, UUID: tl.UUID, Timestamp: tl.Timestamp, Workdir: workdir}
+	at, _ := time.Parse(time.RFC3339, tl.Timestamp)
+
+	var events []TranscriptEvent
+	switch tl.Type {
+	case "user":
+		if tl.Message == nil || tl.IsMeta {
+			return nil
+		}
+		prompt := base
+		prompt.Kind = "prompt"
+		for _, b := range contentBlocks(tl.Message.Content) {
+			switch b.Type {
+			case "text":
+				prompt.PromptChars += utf8.RuneCountInString(b.Text)
+			case "tool_result":
+				ev := base
+				ev.Kind = "tool_result"
+				ev.ToolUseID = b.ToolUseID
+				if call, ok := t.pending[b.ToolUseID]; ok {
+					delete(t.pending, b.ToolUseID)
+					ev.Tool = call.tool
+					if !at.IsZero() && !call.at.IsZero() {
+						ev.DurationMs = at.Sub(call.at).Milliseconds()
+					}
+				}
+				if b.IsError {
+					ev.IsError = true
+					ev.Error = shortError(contentText(b.Content))
+				}
+				events = append(events, ev)
+			}
+		}
+		if prompt.PromptChars > 0 {
+			events = append([]TranscriptEvent{prompt}, events...)
+		}
+
+	case "assistant":
+		if tl.Message == nil {
+			return nil
+		}
+		if tl.IsAPIError {
+			ev := base
+			ev.Kind = "error"
+			ev.IsError = true
+			ev.Error = shortError(contentText(tl.Message.Content))
+			return []TranscriptEvent{ev}
+		}
+		for _, b := range contentBlocks(tl.Message.Content) {
+			if b.Type != "tool_use" {
+				continue
+			}
+			ev := base
+			ev.Kind = "tool_use"
+			ev.Tool = b.Name
+			ev.ToolUseID = b.ID
+			ev.Files = toolFiles(b.Input)
+			events = append(events, ev)
+			if len(t.pending) >= maxPendingToolUses {
+				clear(t.pending) // interrupted calls that never got a result
+			}
+			t.pending[b.ID] = pendingToolUse{tool: b.Name, at: at}
+		}
+
+	case "system":
+		if tl.Level == "error" {
+			ev := base
+			ev.Kind = "error"
+			ev.IsError = true
+			ev.Error = shortError(contentText(tl.Content))
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+var errEventsDisabled = errors.New("transcript events are disabled (transcript_events in agent.yaml)")
+
+// EventFilter selects transcript events for get_events. Zero fields match
+// everything.
+type EventFilter struct {
+	Conversation string
+	Workdir      string // this dir and below
+	Since        time.Time
+	Limit        int // most recent matches returned; default defaultAuditLimit
+}
+
+func (f EventFilter) match(e TranscriptEvent) bool {
+	if f.Conversation != "" && e.SessionID != f.Conversation {
+		return false
+	}
+	if f.Workdir != "" && !workdirWithin(e.Workdir, []string{f.Workdir}) {
+		return false
+	}
+	if !f.Since.IsZero() {
+		at, err := time.Parse(time.RFC3339, e.Timestamp)
+		if err != nil || at.Before(f.Since) {
+			return false
+		}
+	}
+	return true
+}
+
+// eventFilter parses the get_events fields of msg.
+func (msg ClientMessage) eventFilter() (EventFilter, error) {
+	f := EventFilter{Conversation: msg.Conversation, Workdir: msg.Workdir, Limit: msg.Limit}
+	if msg.Since != "" {
+		var err error
+		if f.Since, err = time.Parse(time.RFC3339, msg.Since); err != nil {
+			return f, errors.New("since must be an RFC 3339 timestamp")
+		}
+	}
+	return f, nil
+}
+
+// eventLog keeps the most recent transcript events in memory.
+type eventLog struct {
+	mu     sync.Mutex
+	events []TranscriptEvent
+}
+
+func (l *eventLog) Add(events []TranscriptEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, events...)
+	if extra := len(l.events) - maxTranscriptKept; extra > 0 {
+		l.events = append(l.events[:0:0], l.events[extra:]...)
+	}
+}
+
+// Query returns the most recent events p may see matching f, oldest first.
+func (l *eventLog) Query(p *principal, f EventFilter) []TranscriptEvent {
+	if f.Limit <= 0 {
+		f.Limit = defaultAuditLimit
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := []TranscriptEvent{}
+	for i := len(l.events) - 1; i >= 0 && len(result) < f.Limit; i-- {
+		if e := l.events[i]; f.match(e) && p.inScope(e.Workdir) {
+			result = append(result, e)
+		}
+	}
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result
+}
+
+// filterEvents returns the events within p's workdir scope.
+func (p *principal) filterEvents(events []TranscriptEvent) []TranscriptEvent {
+	if len(p.Workdirs) == 0 {
+		return events
+	}
+	result := make([]TranscriptEvent, 0, len(events))
+	for _, e := range events {
+		if p.inScope(e.Workdir) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// broadcastTranscriptEvents sends new transcript events to every subscriber,
+// limited to each one's workdir scope.
+func (s *Server) broadcastTranscriptEvents(events []TranscriptEvent) {
+	s.broadcastScoped(func(p *principal) any {
+		filtered := p.filterEvents(events)
+		if len(filtered) == 0 {
+			return nil
+		}
+		return TranscriptMessage{Type: "transcript_events", Events: filtered}
+	})
+}
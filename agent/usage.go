@@ -3,9 +3,11 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -13,16 +15,19 @@ import (
 
 // UsageEntry is a flat struct sent over WebSocket to the dashboard.
 type UsageEntry struct {
-	SessionID                string `json:"session_id"`
-	RequestID                string `json:"request_id"`
-	UUID                     string `json:"uuid"`
-	Timestamp                string `json:"timestamp"`
-	Model                    string `json:"model"`
-	Workdir                  string `json:"workdir"`
-	InputTokens              int    `json:"input_tokens"`
-	OutputTokens             int    `json:"output_tokens"`
-	CacheCreationInputTokens int    `json:"cache_creation_input_tokens"`
-	CacheReadInputTokens     int    `json:"cache_read_input_tokens"`
+	SessionID                string  `json:"session_id"`
+	RequestID                string  `json:"request_id"`
+	UUID                     string  `json:"uuid"`
+	Timestamp                string  `json:"timestamp"`
+	Model                    string  `json:"model"`
+	Workdir                  string  `json:"workdir"`
+	InputTokens              int     `json:"input_tokens"`
+	OutputTokens             int     `json:"output_tokens"`
+	CacheCreationInputTokens int     `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int     `json:"cache_read_input_tokens"`
+	ServiceTier              string  `json:"service_tier,omitempty"`
+	WebSearchRequests        int     `json:"web_search_requests,omitempty"`
+	Cost                     float64 `json:"cost"` // USD, from the agent's pricing table
 }
 
 // jsonlLine mirrors the on-disk JSONL structure written by Claude Code.
@@ -35,197 +40,570 @@ type jsonlLine struct {
 	Message   *struct {
 		Model string `json:"model"`
 		Usage *struct {
-			InputTokens              int `json:"input_tokens"`
-			OutputTokens             int `json:"output_tokens"`
-			CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
-			CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+			InputTokens              int    `json:"input_tokens"`
+			OutputTokens             int    `json:"output_tokens"`
+			CacheCreationInputTokens int    `json:"cache_creation_input_tokens"`
+			CacheReadInputTokens     int    `json:"cache_read_input_tokens"`
+			ServiceTier              string `json:"service_tier"`
+			ServerToolUse            *struct {
+				WebSearchRequests int `json:"web_search_requests"`
+			} `json:"server_tool_use"`
 		} `json:"usage"`
 	} `json:"message"`
 }
 
+func defaultUsageOffsetsPath() string {
+	return filepath.Join(agentDataDir(), "usage_offsets.json")
+}
+
+// usageCursorSlack is how far before a client's cursor usage_since starts.
+// Entries land in different files in no strict order, so one can be written
+// after a later-stamped one; clients dedup the overlap.
+const usageCursorSlack = time.Minute
+
+// usageBatchSize caps the entries in one usage_entries message.
+const usageBatchSize = 1000
+
+// maxUsageRecords caps the entries kept in memory for usage_since. Past it
+// the oldest tenth is dropped, and cursors before them are served from disk.
+const maxUsageRecords = 100000
+
 type UsageScanner struct {
 	mu          sync.RWMutex
-	fileOffsets map[string]int64
+	fileOffsets map[string]int64 // persisted, so restarts don't resend history
+	offsetsPath string
+	dirty       bool            // fileOffsets changed since last saved
+	replayed    map[string]bool // files read from the start since launch
 	poller      *Poller
-	onChange    func([]UsageEntry) // called with NEW entries only
-	stopCh      chan struct{}
+	folders     map[string]string // project folder -> workdir, from cwd
+	scanned     map[string]bool   // project folders of the last scan
+	records     []UsageEntry      // entries read since launch, for Collect
+	recorded    map[string]bool   // keys of records
+	recordsFrom time.Time         // entries up to here may have been dropped
+	ready       chan struct{}     // closed once the first scan is done
+	readyOnce   sync.Once
+
+	// scanAll reports every project under ~/.claude/projects, not just
+	// live sessions' workdirs. include and exclude (expanded paths) limit
+	// either mode by workdir.
+	scanAll bool
+	include []string
+	exclude []string
+
+	onChange func([]UsageEntry) // called with NEW entries only
+	onReplay func([]UsageEntry) // entries sent before a restart, re-read once
+
+	// events, when set, turns fresh transcript lines into onEvents calls.
+	events   *transcriptParser
+	onEvents func([]TranscriptEvent)
+
+	stopCh chan struct{}
 }
 
-func newUsageScanner(poller *Poller) *UsageScanner {
-	return &UsageScanner{
+func newUsageScanner(poller *Poller, offsetsPath string) *UsageScanner {
+	u := &UsageScanner{
 		fileOffsets: make(map[string]int64),
+		offsetsPath: offsetsPath,
+		replayed:    make(map[string]bool),
 		poller:      poller,
+		folders:     make(map[string]string),
+		recorded:    make(map[string]bool),
+		ready:       make(chan struct{}),
 		stopCh:      make(chan struct{}),
 	}
+	if data, err := os.ReadFile(offsetsPath); err == nil {
+		if err := json.Unmarshal(data, &u.fileOffsets); err != nil || u.fileOffsets == nil {
+			log.Printf("usage: ignoring %s: %v", offsetsPath, err)
+			u.fileOffsets = make(map[string]int64)
+		}
+	}
+	return u
 }
 
+// Start scans whenever Claude writes under ~/.claude/projects, falling back
+// to scanning every interval where file notifications aren't available.
 func (u *UsageScanner) Start(interval time.Duration) {
 	go func() {
-		ticker := time.NewTicker(interval)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				u.scan()
-			case <-u.stopCh:
-				return
-			}
+		w, err := newDirWatcher()
+		if err != nil {
+			log.Printf("usage: %v; polling every %s", err, interval)
+			u.poll(interval)
+			return
 		}
+		defer w.Close()
+		u.watch(w, interval)
 	}()
 }
 
+func (u *UsageScanner) poll(interval time.Duration) {
+	u.scan()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			u.scan()
+		case <-u.stopCh:
+			return
+		}
+	}
+}
+
 func (u *UsageScanner) Stop() {
 	close(u.stopCh)
 }
 
-// RescanAll resets file offsets so the next scan re-reads everything.
-// Used when a new subscriber connects to ensure it gets all historical data.
-func (u *UsageScanner) RescanAll() {
-	u.mu.Lock()
-	count := len(u.fileOffsets)
-	u.fileOffsets = make(map[string]int64)
-	u.mu.Unlock()
-	log.Printf("usage: RescanAll — reset %d file offsets, triggering scan", count)
-	go u.scan()
+func usageProjectsRoot() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".claude", "projects")
 }
 
-func (u *UsageScanner) scan() {
-	sessions := u.poller.GetSessions()
+// usageProject is a ~/.claude/projects folder and the workdir its usage is
+// reported under.
+type usageProject struct {
+	dir     string
+	workdir string
+}
+
+// projects lists the project folders to scan: those of live sessions'
+// workdirs or, with scanAll, every folder whose workdir is known.
+func (u *UsageScanner) projects() []usageProject {
+	root := usageProjectsRoot()
+	if root == "" {
+		return nil
+	}
+
+	var result []usageProject
+	if u.scanAll {
+		dirs, _ := filepath.Glob(filepath.Join(root, "*"))
+		for _, dir := range dirs {
+			if workdir := u.folderWorkdir(dir); workdir != "" && u.wanted(workdir) {
+				result = append(result, usageProject{dir: dir, workdir: workdir})
+			}
+		}
+		return result
+	}
 
 	// Collect unique workdirs.
 	workdirSet := make(map[string]bool)
-	for _, s := range sessions {
-		if s.Workdir != "" {
+	for _, s := range u.poller.GetSessions() {
+		if s.Workdir != "" && u.wanted(s.Workdir) {
 			workdirSet[s.Workdir] = true
 		}
 	}
+	for workdir := range workdirSet {
+		result = append(result, usageProject{dir: filepath.Join(root, workdirToFolder(workdir)), workdir: workdir})
+	}
+	return result
+}
 
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return
+// wanted applies the include and exclude lists to a workdir.
+func (u *UsageScanner) wanted(workdir string) bool {
+	if len(u.include) > 0 && !workdirWithin(workdir, u.include) {
+		return false
 	}
+	return len(u.exclude) == 0 || !workdirWithin(workdir, u.exclude)
+}
 
-	var allNew []UsageEntry
-	for workdir := range workdirSet {
-		folder := workdirToFolder(workdir)
-		base := filepath.Join(home, ".claude", "projects", folder)
+// folderWorkdir returns the workdir a project folder belongs to, read from
+// the cwd its JSONL lines record, since folder names can't be mapped back
+// (both "/" and "-" become "-"). A cwd that maps to the folder's name wins
+// over one Claude moved into later. "" means no cwd has been logged yet.
+func (u *UsageScanner) folderWorkdir(dir string) string {
+	u.mu.RLock()
+	workdir, ok := u.folders[dir]
+	u.mu.RUnlock()
+	if ok {
+		return workdir
+	}
 
-		newEntries := u.scanDir(base, workdir)
-		allNew = append(allNew, newEntries...)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	name := filepath.Base(dir)
+	for _, path := range files {
+		cwd := firstCwd(path)
+		if cwd == "" {
+			continue
+		}
+		if workdir == "" {
+			workdir = cwd
+		}
+		if workdirToFolder(cwd) == name {
+			workdir = cwd
+			break
+		}
+	}
+	if workdir != "" {
+		u.mu.Lock()
+		u.folders[dir] = workdir
+		u.mu.Unlock()
+	}
+	return workdir
+}
+
+// cwdScanLines is how far into a JSONL file firstCwd looks.
+const cwdScanLines = 50
+
+// firstCwd returns the first cwd recorded in a JSONL file.
+func firstCwd(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 256*1024)
+	for i := 0; i < cwdScanLines; i++ {
+		data, err := r.ReadBytes('\n')
+		var line struct {
+			Cwd string `json:"cwd"`
+		}
+		if json.Unmarshal(data, &line) == nil && line.Cwd != "" {
+			return line.Cwd
+		}
+		if err != nil {
+			break
+		}
 	}
+	return ""
+}
 
-	log.Printf("usage: scan found %d entries from %d workdirs", len(allNew), len(workdirSet))
+// usageBatch is what one scan found.
+type usageBatch struct {
+	fresh    []UsageEntry
+	replayed []UsageEntry
+	events   []TranscriptEvent // fresh lines only, with events enabled
+}
 
-	if len(allNew) == 0 {
+func (u *UsageScanner) scan() {
+	projects := u.projects()
+
+	var b usageBatch
+	u.scanned = make(map[string]bool, len(projects))
+	for _, project := range projects {
+		u.scanned[project.dir] = true
+		u.scanDir(project.dir, project.workdir, &b)
+	}
+
+	u.record(b.replayed)
+	u.record(b.fresh)
+	u.readyOnce.Do(func() { close(u.ready) })
+	if len(b.replayed) > 0 && u.onReplay != nil {
+		u.onReplay(b.replayed)
+	}
+	u.saveOffsets()
+	if len(b.events) > 0 && u.onEvents != nil {
+		u.onEvents(b.events)
+	}
+	if len(b.fresh) == 0 {
 		return
 	}
+	log.Printf("usage: scan found %d entries from %d projects", len(b.fresh), len(projects))
 
 	if u.onChange != nil {
-		u.onChange(allNew)
+		u.onChange(b.fresh)
+	}
+}
+
+// newProjects reports whether a session started since the last scan in a
+// workdir it didn't cover. It reads nothing from disk: with scanAll, new
+// project folders arrive as events on the projects root instead.
+func (u *UsageScanner) newProjects() bool {
+	if u.scanAll {
+		return false
 	}
+	for _, project := range u.projects() {
+		if !u.scanned[project.dir] {
+			return true
+		}
+	}
+	return false
 }
 
-func (u *UsageScanner) scanDir(base, workdir string) []UsageEntry {
-	var result []UsageEntry
+func (u *UsageScanner) scanDir(base, workdir string, b *usageBatch) {
+	for _, f := range projectFiles(base) {
+		u.scanFile(f, workdir, b)
+	}
+}
 
+// projectFiles lists the JSONL files of a project folder.
+func projectFiles(base string) []string {
 	// Top-level *.jsonl
 	topFiles, _ := filepath.Glob(filepath.Join(base, "*.jsonl"))
-	for _, f := range topFiles {
-		result = append(result, u.scanFile(f, workdir)...)
-	}
 
 	// Subagent files: {session-uuid}/subagents/agent-*.jsonl
-	subDirs, _ := filepath.Glob(filepath.Join(base, "*", "subagents"))
-	for _, subDir := range subDirs {
-		subFiles, _ := filepath.Glob(filepath.Join(subDir, "*.jsonl"))
-		for _, f := range subFiles {
-			result = append(result, u.scanFile(f, workdir)...)
+	subFiles, _ := filepath.Glob(filepath.Join(base, "*", "subagents", "*.jsonl"))
+
+	return append(topFiles, subFiles...)
+}
+
+// record keeps entries for Collect, once each: a truncated file is read
+// again from the start.
+func (u *UsageScanner) record(entries []UsageEntry) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, e := range entries {
+		key := e.key()
+		if u.recorded[key] {
+			continue
+		}
+		if !u.recordsFrom.IsZero() {
+			if ts, err := time.Parse(time.RFC3339, e.Timestamp); err != nil || !ts.After(u.recordsFrom) {
+				continue // Collect reads these from disk
+			}
 		}
+		u.recorded[key] = true
+		u.records = append(u.records, e)
+	}
+	if len(u.records) <= maxUsageRecords {
+		return
 	}
 
-	return result
+	// Drop the oldest tenth. Claude stamps lines in UTC with a fixed
+	// width, so the timestamps sort as strings.
+	slices.SortStableFunc(u.records, func(a, b UsageEntry) int {
+		return strings.Compare(a.Timestamp, b.Timestamp)
+	})
+	drop := len(u.records) - maxUsageRecords*9/10
+	for _, e := range u.records[:drop] {
+		delete(u.recorded, e.key())
+	}
+	if ts, err := time.Parse(time.RFC3339, u.records[drop-1].Timestamp); err == nil {
+		u.recordsFrom = ts
+	}
+	u.records = slices.Clone(u.records[drop:])
 }
 
-func (u *UsageScanner) scanFile(path, workdir string) []UsageEntry {
+// scanFile adds the entries appended to path since the last scan to b. The
+// first time a file is scanned after launch it is read from the start, and
+// entries before the persisted offset come back as replayed: they were sent
+// before a restart but the cost tracker still needs them.
+func (u *UsageScanner) scanFile(path, workdir string, b *usageBatch) {
 	u.mu.Lock()
-	offset := u.fileOffsets[path]
+	stored := u.fileOffsets[path]
+	replay := !u.replayed[path]
+	u.replayed[path] = true
 	u.mu.Unlock()
 
 	info, err := os.Stat(path)
 	if err != nil {
-		return nil
+		return
 	}
 
 	// File truncated/rotated — reset offset. Dedup protects against re-reads.
+	offset := stored
 	if info.Size() < offset {
 		offset = 0
 	}
 
 	// Nothing new to read.
-	if info.Size() == offset {
-		return nil
+	if info.Size() == offset && (!replay || offset == 0) {
+		return
 	}
 
 	f, err := os.Open(path)
 	if err != nil {
-		return nil
+		return
 	}
 	defer f.Close()
 
-	if offset > 0 {
-		if _, err := f.Seek(offset, 0); err != nil {
-			return nil
+	pos := int64(0)
+	if !replay && offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return
 		}
+		pos = offset
 	}
 
-	var entries []UsageEntry
-	scanner := bufio.NewScanner(f)
-	scanner.Buffer(make([]byte, 256*1024), 1024*1024)
-
-	for scanner.Scan() {
-		line := scanner.Bytes()
-		if len(line) == 0 {
-			continue
+	reader := bufio.NewReaderSize(f, 256*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// A line without its newline is still being written; pick it
+			// up whole on the next scan.
+			if err != io.EOF {
+				log.Printf("usage: scan error %s: %v", path, err)
+			}
+			break
 		}
+		start := pos
+		pos += int64(len(line))
 
-		var jl jsonlLine
-		if err := json.Unmarshal(line, &jl); err != nil {
+		if start < offset {
+			if entry, ok := parseUsageLine(line, workdir); ok {
+				b.replayed = append(b.replayed, entry)
+			}
 			continue
 		}
-
-		if jl.Type != "assistant" || jl.Message == nil || jl.Message.Usage == nil {
-			continue
+		if entry, ok := parseUsageLine(line, workdir); ok {
+			b.fresh = append(b.fresh, entry)
+		}
+		if u.events != nil {
+			b.events = append(b.events, u.events.parse(line, workdir)...)
 		}
+	}
+
+	if pos != stored {
+		u.mu.Lock()
+		u.fileOffsets[path] = pos
+		u.dirty = true
+		u.mu.Unlock()
+	}
+}
+
+// saveOffsets writes fileOffsets atomically if they changed.
+func (u *UsageScanner) saveOffsets() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.dirty || u.offsetsPath == "" {
+		return
+	}
+	data, err := json.Marshal(u.fileOffsets)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(u.offsetsPath), 0700); err != nil {
+		log.Printf("usage: %v", err)
+		return
+	}
+	tmp := u.offsetsPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("usage: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, u.offsetsPath); err != nil {
+		log.Printf("usage: %v", err)
+		return
+	}
+	u.dirty = false
+}
 
-		entries = append(entries, UsageEntry{
-			SessionID:                jl.SessionID,
-			RequestID:                jl.RequestID,
-			UUID:                     jl.UUID,
-			Timestamp:                jl.Timestamp,
-			Model:                    jl.Message.Model,
-			Workdir:                  workdir,
-			InputTokens:              jl.Message.Usage.InputTokens,
-			OutputTokens:             jl.Message.Usage.OutputTokens,
-			CacheCreationInputTokens: jl.Message.Usage.CacheCreationInputTokens,
-			CacheReadInputTokens:     jl.Message.Usage.CacheReadInputTokens,
-		})
+// parseUsageLine extracts a UsageEntry from an assistant line with usage.
+func parseUsageLine(line []byte, workdir string) (UsageEntry, bool) {
+	var jl jsonlLine
+	if err := json.Unmarshal(line, &jl); err != nil {
+		return UsageEntry{}, false
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Printf("usage: scan error %s: %v", path, err)
+	if jl.Type != "assistant" || jl.Message == nil || jl.Message.Usage == nil {
+		return UsageEntry{}, false
 	}
 
-	// Update offset to current file position.
-	newOffset, err := f.Seek(0, 1) // SEEK_CUR
-	if err == nil {
-		u.mu.Lock()
-		u.fileOffsets[path] = newOffset
-		u.mu.Unlock()
+	entry := UsageEntry{
+		SessionID:                jl.SessionID,
+		RequestID:                jl.RequestID,
+		UUID:                     jl.UUID,
+		Timestamp:                jl.Timestamp,
+		Model:                    jl.Message.Model,
+		Workdir:                  workdir,
+		InputTokens:              jl.Message.Usage.InputTokens,
+		OutputTokens:             jl.Message.Usage.OutputTokens,
+		CacheCreationInputTokens: jl.Message.Usage.CacheCreationInputTokens,
+		CacheReadInputTokens:     jl.Message.Usage.CacheReadInputTokens,
+		ServiceTier:              jl.Message.Usage.ServiceTier,
+	}
+	if jl.Message.Usage.ServerToolUse != nil {
+		entry.WebSearchRequests = jl.Message.Usage.ServerToolUse.WebSearchRequests
+	}
+	return entry, true
+}
+
+// Collect returns the usage entries of the projects now scanned with a
+// timestamp at or after since. It waits for the first scan, then answers
+// from memory unless since reaches back past the entries kept there.
+func (u *UsageScanner) Collect(since time.Time) []UsageEntry {
+	select {
+	case <-u.ready:
+	case <-u.stopCh:
+		return []UsageEntry{}
+	}
+
+	projects := u.projects()
+	u.mu.RLock()
+	if !u.recordsFrom.IsZero() && !since.After(u.recordsFrom) {
+		u.mu.RUnlock()
+		return collectFiles(projects, since)
+	}
+	defer u.mu.RUnlock()
+
+	workdirs := make(map[string]bool)
+	for _, project := range projects {
+		workdirs[project.workdir] = true
+	}
+	result := []UsageEntry{}
+	for _, e := range u.records {
+		if workdirs[e.Workdir] && stampedSince(e, since) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// collectFiles reads the usage entries stamped at or after since from the
+// projects' files.
+func collectFiles(projects []usageProject, since time.Time) []UsageEntry {
+	result := []UsageEntry{}
+	seen := make(map[string]bool)
+	for _, project := range projects {
+		for _, path := range projectFiles(project.dir) {
+			f, err := os.Open(path)
+			if err != nil {
+				continue
+			}
+			reader := bufio.NewReaderSize(f, 256*1024)
+			for {
+				line, err := reader.ReadBytes('\n')
+				if err != nil {
+					break
+				}
+				e, ok := parseUsageLine(line, project.workdir)
+				if ok && !seen[e.key()] && stampedSince(e, since) {
+					seen[e.key()] = true
+					result = append(result, e)
+				}
+			}
+			f.Close()
+		}
+	}
+	return result
+}
+
+// stampedSince reports whether e is stamped at or after since; a zero since
+// takes everything.
+func stampedSince(e UsageEntry, since time.Time) bool {
+	if since.IsZero() {
+		return true
 	}
+	ts, err := time.Parse(time.RFC3339, e.Timestamp)
+	return err == nil && !ts.Before(since)
+}
 
-	return entries
+// key identifies an entry across re-reads, as the cost tracker dedups it.
+func (e UsageEntry) key() string {
+	return e.RequestID + "/" + e.UUID
 }
 
+// usageCursor returns the latest timestamp among entries, for clients to
+// pass back to usage_since, or "" if there are none.
+func usageCursor(entries []UsageEntry) string {
+	var latest time.Time
+	cursor := ""
+	for _, e := range entries {
+		if t, err := time.Parse(time.RFC3339, e.Timestamp); err == nil && t.After(latest) {
+			latest, cursor = t, e.Timestamp
+		}
+	}
+	return cursor
+}
+
+// workdirToFolder is Claude Code's project folder name for a workdir: every
+// character other than an ASCII letter or digit becomes "-".
 func workdirToFolder(workdir string) string {
-	return strings.ReplaceAll(workdir, "/", "-")
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '-'
+	}, workdir)
 }
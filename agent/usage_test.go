@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWorkdirToFolder(t *testing.T) {
+	tests := []struct {
+		workdir, folder string
+	}{
+		{"/home/me/proj", "-home-me-proj"},
+		{"/home/me/my-proj", "-home-me-my-proj"},
+		{"/home/me/my_proj.v2", "-home-me-my-proj-v2"},
+		{"/Users/Me/Code 2", "-Users-Me-Code-2"},
+		{"/home/me/проект", "-home-me-------"},
+		{"C:\\Users\\me", "C--Users-me"},
+	}
+	for _, tt := range tests {
+		if got := workdirToFolder(tt.workdir); got != tt.folder {
+			t.Errorf("workdirToFolder(%q) = %q, want %q", tt.workdir, got, tt.folder)
+		}
+	}
+}
+
+func TestFolderWorkdir(t *testing.T) {
+	root := t.TempDir()
+	write := func(folder, file string, lines ...string) string {
+		dir := filepath.Join(root, folder)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		data := strings.Join(lines, "\n") + "\n"
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	cwdLine := func(cwd string) string { return `{"type":"user","cwd":"` + cwd + `"}` }
+
+	tests := []struct {
+		name    string
+		dir     string
+		workdir string
+	}{
+		{
+			// "-" and "/" both map to "-", so the name alone is ambiguous.
+			name:    "dash in the path",
+			dir:     write("-home-me-my-proj", "a.jsonl", `{"type":"summary"}`, cwdLine("/home/me/my-proj")),
+			workdir: "/home/me/my-proj",
+		},
+		{
+			name: "cwd matching the folder name wins",
+			dir: func() string {
+				write("-home-me-app", "a.jsonl", cwdLine("/home/me/app/sub"))
+				return write("-home-me-app", "b.jsonl", cwdLine("/home/me/app"))
+			}(),
+			workdir: "/home/me/app",
+		},
+		{
+			name:    "any cwd when none matches",
+			dir:     write("-home-me-moved", "a.jsonl", cwdLine("/srv/moved")),
+			workdir: "/srv/moved",
+		},
+		{
+			name:    "long line before the cwd",
+			dir:     write("-home-me-big", "a.jsonl", `{"type":"user","text":"`+strings.Repeat("x", 2<<20)+`"}`, cwdLine("/home/me/big")),
+			workdir: "/home/me/big",
+		},
+		{
+			name:    "no cwd logged",
+			dir:     write("-home-me-empty", "a.jsonl", `{"type":"summary"}`),
+			workdir: "",
+		},
+		{
+			name:    "missing folder",
+			dir:     filepath.Join(root, "-nowhere"),
+			workdir: "",
+		},
+	}
+	u := newUsageScanner(nil, "")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := u.folderWorkdir(tt.dir); got != tt.workdir {
+				t.Errorf("folderWorkdir = %q, want %q", got, tt.workdir)
+			}
+		})
+	}
+
+	// Known workdirs are cached; unknown ones are looked up again.
+	if _, ok := u.folders[filepath.Join(root, "-home-me-empty")]; ok {
+		t.Errorf("empty folder cached")
+	}
+	write("-home-me-empty", "b.jsonl", cwdLine("/home/me/empty"))
+	if got := u.folderWorkdir(filepath.Join(root, "-home-me-empty")); got != "/home/me/empty" {
+		t.Errorf("folderWorkdir after a cwd was logged = %q", got)
+	}
+}
+
+func TestUsageRecordDedupAndCap(t *testing.T) {
+	u := newUsageScanner(nil, "")
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	entry := func(i int) UsageEntry {
+		return UsageEntry{RequestID: fmt.Sprint("r", i), UUID: "u", Timestamp: start.Add(time.Duration(i) * time.Second).Format(time.RFC3339)}
+	}
+
+	batch := []UsageEntry{entry(0), entry(1)}
+	u.record(batch)
+	u.record(batch) // a truncated file read again
+	if len(u.records) != 2 {
+		t.Fatalf("kept %d records, want 2", len(u.records))
+	}
+
+	var many []UsageEntry
+	for i := 2; i <= maxUsageRecords; i++ {
+		many = append(many, entry(i))
+	}
+	u.record(many)
+	if len(u.records) != maxUsageRecords*9/10 || len(u.recorded) != len(u.records) {
+		t.Fatalf("kept %d records (%d keys), want %d", len(u.records), len(u.recorded), maxUsageRecords*9/10)
+	}
+	oldest := maxUsageRecords + 1 - len(u.records)
+	if u.records[0].RequestID != fmt.Sprint("r", oldest) {
+		t.Errorf("oldest kept = %s, want r%d", u.records[0].RequestID, oldest)
+	}
+	if want := start.Add(time.Duration(oldest-1) * time.Second); !u.recordsFrom.Equal(want) {
+		t.Errorf("recordsFrom = %s, want %s", u.recordsFrom, want)
+	}
+
+	// Dropped entries read again stay out; Collect reads them from disk.
+	u.record([]UsageEntry{entry(0)})
+	if len(u.records) != maxUsageRecords*9/10 {
+		t.Errorf("dropped entry recorded again")
+	}
+}
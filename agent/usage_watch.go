@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// usageDebounce is how long the scanner waits after a change before
+// scanning, so a burst of appends costs one scan.
+const usageDebounce = 300 * time.Millisecond
+
+// dirEvent is a change in a watched directory.
+type dirEvent struct {
+	rewatch bool // a directory appeared, or events were lost
+}
+
+// watch scans when files under the projects root change, which includes a
+// project folder appearing in the root, or when a session opens in a
+// workdir the last scan didn't cover. It reads nothing from disk otherwise.
+// While the root doesn't exist, or a watch can't be added, it scans every
+// interval instead and keeps trying to watch.
+func (u *UsageScanner) watch(w *dirWatcher, interval time.Duration) {
+	root := usageProjectsRoot()
+	watching := u.rewatch(w, root, true)
+	u.scan()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var debounce <-chan time.Time
+	rewatch := false
+	for {
+		select {
+		case ev, ok := <-w.Events():
+			if !ok {
+				log.Printf("usage: file notifications stopped; polling every %s", interval)
+				u.poll(interval)
+				return
+			}
+			rewatch = rewatch || ev.rewatch
+			if debounce == nil {
+				debounce = time.After(usageDebounce)
+			}
+		case <-debounce:
+			debounce = nil
+			if rewatch {
+				rewatch = false
+				watching = u.rewatch(w, root, watching)
+			}
+			u.scan()
+		case <-ticker.C:
+			if !watching {
+				watching = u.rewatch(w, root, watching)
+				u.scan()
+			} else if u.newProjects() {
+				u.scan()
+			}
+		case <-u.stopCh:
+			return
+		}
+	}
+}
+
+// rewatch adds watches for new directories, logging when falling back to
+// polling or recovering from it.
+func (u *UsageScanner) rewatch(w *dirWatcher, root string, watching bool) bool {
+	err := u.watchTree(w, root)
+	if err != nil && watching {
+		log.Printf("usage: %v; polling until it can be watched", err)
+	} else if err == nil && !watching {
+		log.Printf("usage: watching %s", root)
+	}
+	return err == nil
+}
+
+// watchTree watches the directories Claude writes JSONL into: the projects
+// root (for new projects), each project folder, each conversation's folder
+// (for new subagents folders) and each subagents folder.
+func (u *UsageScanner) watchTree(w *dirWatcher, root string) error {
+	if err := w.Add(root); err != nil {
+		return err
+	}
+	projects, _ := filepath.Glob(filepath.Join(root, "*"))
+	convs, _ := filepath.Glob(filepath.Join(root, "*", "*"))
+	subagents, _ := filepath.Glob(filepath.Join(root, "*", "*", "subagents"))
+	for _, dir := range append(append(projects, convs...), subagents...) {
+		if filepath.Ext(dir) == ".jsonl" {
+			continue
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := w.Add(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_MODIFY | syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+
+// dirWatcher reports changes in directories via inotify.
+type dirWatcher struct {
+	fd     int
+	file   *os.File // fd, for reads the runtime poller can interrupt
+	events chan dirEvent
+	done   chan struct{}
+
+	mu      sync.Mutex
+	watches map[string]int32 // dir -> watch descriptor
+	dirs    map[int32]string
+}
+
+func newDirWatcher() (*dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+	w := &dirWatcher{
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		events:  make(chan dirEvent, 16),
+		done:    make(chan struct{}),
+		watches: make(map[string]int32),
+		dirs:    make(map[int32]string),
+	}
+	go w.read()
+	return w, nil
+}
+
+// Add watches dir; watching a dir again is a no-op.
+func (w *dirWatcher) Add(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.watches[dir]; ok {
+		return nil
+	}
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+	if err != nil {
+		return fmt.Errorf("watching %s: %w", dir, err)
+	}
+	w.watches[dir] = int32(wd)
+	w.dirs[int32(wd)] = dir
+	return nil
+}
+
+// Events delivers changes; it is closed if reading inotify fails.
+func (w *dirWatcher) Events() <-chan dirEvent {
+	return w.events
+}
+
+func (w *dirWatcher) Close() error {
+	close(w.done)
+	return w.file.Close()
+}
+
+func (w *dirWatcher) read() {
+	defer close(w.events)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			off += syscall.SizeofInotifyEvent + int(raw.Len)
+
+			var ev dirEvent
+			switch {
+			case raw.Mask&syscall.IN_Q_OVERFLOW != 0:
+				ev.rewatch = true
+			case raw.Mask&syscall.IN_IGNORED != 0:
+				w.forget(raw.Wd) // the dir was removed
+				continue
+			case raw.Mask&syscall.IN_ISDIR != 0:
+				ev.rewatch = raw.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0
+			}
+			select {
+			case w.events <- ev:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+func (w *dirWatcher) forget(wd int32) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.watches, w.dirs[wd])
+	delete(w.dirs, wd)
+}
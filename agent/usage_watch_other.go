@@ -0,0 +1,29 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+// dirWatcher is unavailable here; the usage scanner polls instead.
+type dirWatcher struct {
+	events chan dirEvent
+}
+
+func newDirWatcher() (*dirWatcher, error) {
+	return nil, errors.New("file notifications are not supported on " + runtime.GOOS)
+}
+
+func (w *dirWatcher) Add(dir string) error {
+	return errors.ErrUnsupported
+}
+
+func (w *dirWatcher) Events() <-chan dirEvent {
+	return w.events
+}
+
+func (w *dirWatcher) Close() error {
+	return nil
+}
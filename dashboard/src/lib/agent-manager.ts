@@ -66,8 +66,13 @@ class AgentConnection {
       return;
     }
 
-    this.ws.on("open", () => {
-      this.ws!.send(JSON.stringify({ type: "auth", data: this.config.token }));
+    this.ws.on("open", async () => {
+      const ws = this.ws!;
+      // Ask only for usage newer than what's stored; the agent sends it
+      // before any live entries.
+      const usageCursor = await this.usageCursor();
+      if (ws !== this.ws || ws.readyState !== WebSocket.OPEN) return;
+      ws.send(JSON.stringify({ type: "auth", data: this.config.token, usage_cursor: usageCursor }));
       this.online = true;
       this.reconnectDelay = 1000;
       // Socket-level inactivity timeout — auto-resets on any received data
@@ -191,6 +196,22 @@ class AgentConnection {
     }
   }
 
+  // Timestamp of the latest usage entry stored for this server, or "" to
+  // ask the agent for everything.
+  private async usageCursor(): Promise<string> {
+    try {
+      const latest = await prisma.usageEntry.findFirst({
+        where: { userId: this.userId, serverId: this.config.id },
+        orderBy: { timestamp: "desc" },
+        select: { timestamp: true },
+      });
+      return latest?.timestamp.toISOString() ?? "";
+    } catch (e) {
+      console.warn(`[agent] Failed to read usage cursor:`, (e as Error).message);
+      return "";
+    }
+  }
+
   async loadUsageFromDB() {
     const aggregates = await prisma.usageEntry.groupBy({
       by: ["workdir"],